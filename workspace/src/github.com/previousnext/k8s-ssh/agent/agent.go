@@ -0,0 +1,253 @@
+// Package agent relays SSH agent connections from a socket inside a container back to the
+// gateway, multiplexed over the stdin and stdout of a single exec.
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Largest amount of data sent in a single frame.
+const maxFrameSize = 32 * 1024
+
+// Frame types.
+const (
+	// Sent by the relay once it is listening.
+	frameReady byte = iota + 1
+	// Sent by the relay when a new connection is accepted.
+	frameOpen
+	// Data for a connection, sent in both directions.
+	frameData
+	// Sent in both directions when a connection is closed.
+	frameClose
+)
+
+// ErrNotReady is returned by Serve if the relay exits before it is listening.
+var ErrNotReady = errors.New("agent relay exited before it was ready")
+
+// Dialer opens a connection to the client's agent.
+type Dialer func() (io.ReadWriteCloser, error)
+
+// Relay accepts connections on the listener and multiplexes them over r and w, until r is
+// closed. The listener and any open connections are closed before it returns.
+func Relay(l net.Listener, r io.Reader, w io.Writer) error {
+	m := newMux(w)
+
+	defer m.closeAll()
+	defer l.Close()
+
+	if err := m.send(frameReady, 0, nil); err != nil {
+		return err
+	}
+
+	go func() {
+		var id uint32
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			id++
+
+			m.add(id, conn)
+
+			if err := m.send(frameOpen, id, nil); err != nil {
+				conn.Close()
+				return
+			}
+
+			go m.pump(id, conn)
+		}
+	}()
+
+	return m.read(r, nil)
+}
+
+// Serve reads the connections multiplexed by a relay from r and w, connecting each one to
+// the agent with dial. Ready is called once the relay is listening.
+func Serve(r io.Reader, w io.Writer, dial Dialer, ready func()) error {
+	m := newMux(w)
+
+	defer m.closeAll()
+
+	var once sync.Once
+
+	err := m.read(r, func(typ byte, id uint32) {
+		switch typ {
+		case frameReady:
+			once.Do(ready)
+
+		case frameOpen:
+			conn, err := dial()
+			if err != nil {
+				m.send(frameClose, id, nil)
+				return
+			}
+
+			m.add(id, conn)
+
+			go m.pump(id, conn)
+		}
+	})
+
+	ok := false
+	once.Do(func() { ok = true })
+
+	if ok && err == nil {
+		return ErrNotReady
+	}
+
+	return err
+}
+
+// Multiplexes connections over a single stream.
+type mux struct {
+	wmu sync.Mutex
+	w   io.Writer
+
+	mu    sync.Mutex
+	conns map[uint32]io.ReadWriteCloser
+}
+
+func newMux(w io.Writer) *mux {
+	return &mux{
+		w:     w,
+		conns: make(map[uint32]io.ReadWriteCloser),
+	}
+}
+
+// Helper function to write a frame.
+func (m *mux) send(typ byte, id uint32, payload []byte) error {
+	header := make([]byte, 9)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], id)
+	binary.BigEndian.PutUint32(header[5:], uint32(len(payload)))
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	if _, err := m.w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Helper function to keep track of a connection.
+func (m *mux) add(id uint32, conn io.ReadWriteCloser) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conns[id] = conn
+}
+
+// Helper function to stop tracking a connection and close it, returning false if it was
+// already closed.
+func (m *mux) remove(id uint32) bool {
+	m.mu.Lock()
+	conn, ok := m.conns[id]
+	delete(m.conns, id)
+	m.mu.Unlock()
+
+	if ok {
+		conn.Close()
+	}
+
+	return ok
+}
+
+// Helper function to look up a connection.
+func (m *mux) get(id uint32) (io.ReadWriteCloser, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn, ok := m.conns[id]
+	return conn, ok
+}
+
+// Helper function to close all of the connections.
+func (m *mux) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, conn := range m.conns {
+		conn.Close()
+		delete(m.conns, id)
+	}
+}
+
+// Helper function to send everything read from a connection to the other side, telling
+// it when the connection is closed.
+func (m *mux) pump(id uint32, conn io.Reader) {
+	buf := make([]byte, maxFrameSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if m.send(frameData, id, buf[:n]) != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// The other side is only told if it did not close the connection itself.
+	if m.remove(id) {
+		m.send(frameClose, id, nil)
+	}
+}
+
+// Helper function to read frames until r is closed, handling data and close frames and
+// passing any others to the control function.
+func (m *mux) read(r io.Reader, control func(typ byte, id uint32)) error {
+	header := make([]byte, 9)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+
+		if length > maxFrameSize {
+			return errors.New("agent frame is too large")
+		}
+
+		payload := make([]byte, length)
+
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameData:
+			if conn, ok := m.get(id); ok {
+				if _, err := conn.Write(payload); err != nil {
+					m.remove(id)
+					m.send(frameClose, id, nil)
+				}
+			}
+
+		case frameClose:
+			m.remove(id)
+
+		default:
+			if control != nil {
+				control(typ, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestRelay(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+
+	keyring := sshagent.NewKeyring()
+	assert.Nil(t, keyring.Add(sshagent.AddedKey{PrivateKey: key, Comment: "test"}))
+
+	dir, err := ioutil.TempDir("", "agent")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	assert.Nil(t, err)
+
+	// Pipes standing in for the stdin and stdout of the exec.
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	relayed := make(chan error, 1)
+
+	go func() {
+		relayed <- Relay(listener, stdinR, stdoutW)
+		stdoutW.Close()
+	}()
+
+	dial := func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go sshagent.ServeAgent(keyring, server)
+		return client, nil
+	}
+
+	ready := make(chan struct{})
+	served := make(chan error, 1)
+
+	go func() {
+		served <- Serve(stdoutR, stdinW, dial, func() { close(ready) })
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay was not ready")
+	}
+
+	// Each connection to the socket is relayed separately.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", filepath.Join(dir, "agent.sock"))
+		assert.Nil(t, err)
+
+		client := sshagent.NewClient(conn)
+
+		keys, err := client.List()
+		assert.Nil(t, err)
+		assert.Len(t, keys, 1)
+		assert.Equal(t, "test", keys[0].Comment)
+
+		signer, err := gossh.NewSignerFromKey(key)
+		assert.Nil(t, err)
+
+		signature, err := client.Sign(signer.PublicKey(), []byte("data"))
+		assert.Nil(t, err)
+		assert.Nil(t, signer.PublicKey().Verify([]byte("data"), signature))
+
+		conn.Close()
+	}
+
+	// Closing stdin stops the relay.
+	stdinW.Close()
+	assert.Nil(t, <-relayed)
+	assert.Nil(t, <-served)
+
+	_, err = net.Dial("unix", filepath.Join(dir, "agent.sock"))
+	assert.NotNil(t, err)
+}
+
+func TestServeNotReady(t *testing.T) {
+	r, w := io.Pipe()
+	w.Close()
+
+	err := Serve(r, ioutil.Discard, nil, func() {})
+	assert.Equal(t, ErrNotReady, err)
+}
@@ -0,0 +1,247 @@
+package audit
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Types of audit events.
+const (
+	// TypeAuthAttempt is emitted when a client offers a public key.
+	TypeAuthAttempt = "auth.attempt"
+	// TypeAuthResult is emitted once the key has been accepted or rejected.
+	TypeAuthResult = "auth.result"
+	// TypeSessionStart is emitted once a session has been routed to a container.
+	TypeSessionStart = "session.start"
+	// TypeCommand is emitted with the command run in the container.
+	TypeCommand = "session.command"
+	// TypeSessionJoin is emitted when a user joins a shared session.
+	TypeSessionJoin = "session.join"
+	// TypeSessionLeave is emitted when a user leaves a shared session.
+	TypeSessionLeave = "session.leave"
+	// TypeSessionEnd is emitted when a session ends, with how long it ran and what it sent.
+	TypeSessionEnd = "session.end"
+	// TypeForwardOpen is emitted when a port forward is opened.
+	TypeForwardOpen = "forward.open"
+)
+
+// Event is a single entry in the audit log. Fields which do not apply to the type are left empty.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Position in a hash chained log, see Chain.
+	Seq  uint64 `json:"seq,omitempty"`
+	Prev string `json:"prev,omitempty"`
+
+	// Who the event is about.
+	Session     string `json:"session,omitempty"`
+	User        string `json:"user,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	RemoteAddr  string `json:"remoteAddr,omitempty"`
+
+	// Where the session is running.
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+
+	// Result of an authentication attempt.
+	Success *bool `json:"success,omitempty"`
+
+	// Why authentication was accepted or rejected, or why the gateway closed a session eg. an
+	// idle timeout.
+	Reason string `json:"reason,omitempty"`
+
+	// What was run.
+	Command   string `json:"command,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+
+	// Where a port forward goes.
+	Forward *Forward `json:"forward,omitempty"`
+
+	// How the session ended.
+	Duration float64 `json:"duration,omitempty"`
+	BytesIn  int64   `json:"bytesIn,omitempty"`
+	BytesOut int64   `json:"bytesOut,omitempty"`
+	ExitCode *int    `json:"exitCode,omitempty"`
+
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Kinds of port forwards.
+const (
+	// ForwardLocal is a connection from the client to a pod or service eg. "ssh -L" or "ssh -D".
+	ForwardLocal = "local"
+	// ForwardReverse is a port exposed by the client as a service eg. "ssh -R".
+	ForwardReverse = "reverse"
+)
+
+// Forward describes a port forward.
+type Forward struct {
+	Kind string `json:"kind"`
+	Host string `json:"host"`
+	Port uint32 `json:"port"`
+}
+
+// Marshal returns the event as a single line of JSON.
+func (e Event) Marshal() ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(line, '\n'), nil
+}
+
+// Bool returns a pointer to the value, for the optional fields of an event.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Int returns a pointer to the value, for the optional fields of an event.
+func Int(i int) *int {
+	return &i
+}
+
+// Sink delivers audit events somewhere eg. a file or syslog.
+type Sink interface {
+	Write(Event) error
+	Close() error
+}
+
+// Logger sends audit events to each of its sinks.
+type Logger struct {
+	mu      sync.Mutex
+	sinks   []Sink
+	failure func(error)
+
+	chain *Chain
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// New returns a logger which sends events to the sinks. Failures to deliver an event are passed
+// to the function, so they can be logged without holding up the session.
+func New(failure func(error), sinks ...Sink) *Logger {
+	return &Logger{
+		sinks:   sinks,
+		failure: failure,
+	}
+}
+
+// Chain links each event the logger emits to the one before it, signing a checkpoint every
+// interval if there have been new events. A final checkpoint is signed when the logger is closed.
+func (l *Logger) Chain(chain *Chain, interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.chain = chain
+
+	if interval <= 0 {
+		return
+	}
+
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.Checkpoint()
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Emit timestamps the event and sends it to each sink, in the order events are emitted.
+func (l *Logger) Emit(e Event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.emit(e)
+}
+
+// Checkpoint signs the events emitted since the last checkpoint, if the log is chained.
+func (l *Logger) Checkpoint() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.chain == nil || l.chain.unsigned == 0 {
+		return
+	}
+
+	l.emit(Event{
+		Type: TypeCheckpoint,
+	})
+}
+
+// Helper function to send an event to the sinks, while holding the lock.
+func (l *Logger) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	if l.chain != nil {
+		if err := l.chain.link(&e); err != nil {
+			l.fail(err)
+			return
+		}
+	}
+
+	for _, sink := range l.sinks {
+		if err := sink.Write(e); err != nil {
+			l.fail(err)
+		}
+	}
+}
+
+// Helper function to report a failure to deliver an event.
+func (l *Logger) fail(err error) {
+	if l.failure != nil {
+		l.failure(err)
+	}
+}
+
+// Close signs a final checkpoint, then flushes and closes each of the sinks.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.Checkpoint()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var first error
+
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A sink which always fails.
+type failingSink struct{}
+
+func (failingSink) Write(Event) error { return errors.New("failed") }
+func (failingSink) Close() error      { return nil }
+
+func TestLogger(t *testing.T) {
+	var (
+		buf      bytes.Buffer
+		failures []error
+	)
+
+	logger := New(func(err error) {
+		failures = append(failures, err)
+	}, failingSink{}, NewWriterSink(&buf))
+
+	logger.Emit(Event{
+		Type:        TypeAuthResult,
+		Time:        time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		User:        "nick",
+		Fingerprint: "SHA256:abc",
+		Success:     Bool(false),
+	})
+
+	logger.Emit(Event{
+		Type:     TypeSessionEnd,
+		Time:     time.Date(2018, 1, 2, 3, 4, 6, 0, time.UTC),
+		Session:  "abc123",
+		Duration: 1.5,
+		BytesIn:  10,
+		ExitCode: Int(0),
+	})
+
+	assert.Nil(t, logger.Close())
+
+	// Events which failed in one sink are still delivered to the others.
+	assert.Len(t, failures, 2)
+	assert.Equal(t, `{"type":"auth.result","time":"2018-01-02T03:04:05Z","user":"nick","fingerprint":"SHA256:abc","success":false}
+{"type":"session.end","time":"2018-01-02T03:04:06Z","session":"abc123","duration":1.5,"bytesIn":10,"exitCode":0}
+`, buf.String())
+
+	// A nil logger is used when auditing is disabled.
+	var disabled *Logger
+	disabled.Emit(Event{Type: TypeCommand})
+	assert.Nil(t, disabled.Close())
+}
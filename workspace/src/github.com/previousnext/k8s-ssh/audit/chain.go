@@ -0,0 +1,318 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TypeCheckpoint is a record in a hash chained log which signs every record before it.
+const TypeCheckpoint = "audit.checkpoint"
+
+// How far from the end of a log to look for the last record when resuming a chain, doubled
+// until the whole record is found.
+const chainTail = 64 * 1024
+
+// Checkpoint is a signature over the sequence number and previous hash of the record which
+// carries it, and so over every record before it.
+type Checkpoint struct {
+	// Public key of the server, in the authorized_keys format.
+	Key       string `json:"key"`
+	Format    string `json:"format"`
+	Signature []byte `json:"signature"`
+}
+
+// Chain links each record to the one before it, so records which are modified, removed or
+// reordered can be found with a Verifier.
+type Chain struct {
+	signer   gossh.Signer
+	seq      uint64
+	prev     string
+	unsigned int
+}
+
+// NewChain returns a chain which signs checkpoints with the key.
+func NewChain(signer gossh.Signer) *Chain {
+	return &Chain{
+		signer: signer,
+	}
+}
+
+// Resume continues the chain from the last record in a log, so a log which is appended to by
+// each run of the server remains a single chain. A log which has just been rotated has no
+// records, so the chain continues from the newest rotated file. It is not an error for the
+// log not to exist.
+func (c *Chain) Resume(path string) error {
+	for _, name := range []string{path, backupPath(path, 1)} {
+		found, err := c.resume(name)
+		if err != nil || found {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper function to continue the chain from the last record in a file, returning false if
+// the file does not exist or has no records.
+func (c *Chain) resume(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	last, err := lastLine(file, info.Size())
+	if err != nil {
+		return false, err
+	}
+
+	if len(last) == 0 {
+		return false, nil
+	}
+
+	var record Event
+
+	if err := json.Unmarshal(last, &record); err != nil {
+		return false, fmt.Errorf("failed to resume audit chain from %s: %s", path, err)
+	}
+
+	if record.Seq == 0 {
+		return false, fmt.Errorf("failed to resume audit chain from %s: the last record is not chained", path)
+	}
+
+	c.seq = record.Seq
+	c.prev = hash(last)
+	c.unsigned = 0
+
+	return true, nil
+}
+
+// Helper function to read the last line of a file, reading more of the end of the file until
+// the start of the line is found.
+func lastLine(file io.ReaderAt, size int64) ([]byte, error) {
+	for tail := int64(chainTail); ; tail *= 2 {
+		offset := size - tail
+		if offset < 0 {
+			offset = 0
+		}
+
+		data := make([]byte, size-offset)
+
+		if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		data = bytes.TrimRight(data, "\n")
+
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			return data[i+1:], nil
+		}
+
+		if offset == 0 {
+			return data, nil
+		}
+	}
+}
+
+// Helper function to add the event to the chain, signing it if it is a checkpoint. The hash of
+// the event is taken from the line which the sinks will write.
+func (c *Chain) link(e *Event) error {
+	e.Seq = c.seq + 1
+	e.Prev = c.prev
+
+	if e.Type == TypeCheckpoint {
+		sig, err := c.signer.Sign(rand.Reader, checkpointData(e.Seq, e.Prev))
+		if err != nil {
+			return err
+		}
+
+		e.Checkpoint = &Checkpoint{
+			Key:       string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(c.signer.PublicKey()))),
+			Format:    sig.Format,
+			Signature: sig.Blob,
+		}
+	}
+
+	line, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	c.seq = e.Seq
+	c.prev = hash(line[:len(line)-1])
+
+	if e.Type == TypeCheckpoint {
+		c.unsigned = 0
+	} else {
+		c.unsigned++
+	}
+
+	return nil
+}
+
+// Helper function to hash a record, as it appears in the log without the trailing newline.
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Helper function to build what a checkpoint signs.
+func checkpointData(seq uint64, prev string) []byte {
+	return []byte(fmt.Sprintf("k8s-ssh audit checkpoint %d %s", seq, prev))
+}
+
+// Problem is something wrong with a record in a hash chained log.
+type Problem struct {
+	File    string
+	Line    int
+	Seq     uint64
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: seq %d: %s", p.File, p.Line, p.Seq, p.Message)
+}
+
+// Verifier walks the records of a hash chained log, which might be spread across rotated files,
+// and reports records which were modified, removed or reordered.
+type Verifier struct {
+	// Checkpoints must be signed with this key. If it is not set, it is the key which signed
+	// the first checkpoint.
+	Key gossh.PublicKey
+
+	Records     int
+	Checkpoints int
+	// Records after the last checkpoint, which could be changed without being noticed.
+	Unsigned int
+	Problems []Problem
+
+	started bool
+	seq     uint64
+	prev    string
+}
+
+// NewVerifier returns a verifier which expects checkpoints to be signed with the key, or the
+// same key as the first checkpoint if it is nil.
+func NewVerifier(key gossh.PublicKey) *Verifier {
+	return &Verifier{
+		Key: key,
+	}
+}
+
+// Verify checks the records in a file. Files must be verified in the order they were written.
+func (v *Verifier) Verify(name string, r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+
+		if data = bytes.TrimSuffix(data, []byte("\n")); len(data) > 0 {
+			v.record(name, line, data)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Helper function to check a record against the one before it.
+func (v *Verifier) record(name string, line int, data []byte) {
+	problem := func(seq uint64, format string, args ...interface{}) {
+		v.Problems = append(v.Problems, Problem{name, line, seq, fmt.Sprintf(format, args...)})
+	}
+
+	v.Records++
+
+	var record Event
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		problem(v.seq+1, "not a valid record: %s", err)
+		v.seq++
+		v.prev = hash(data)
+		return
+	}
+
+	expected := v.seq + 1
+
+	switch {
+	case record.Seq == 0:
+		problem(record.Seq, "record is not chained")
+	case !v.started:
+		// The log might start part way through the chain, if older files were removed.
+	case record.Seq == 1 && record.Prev == "":
+		problem(record.Seq, "chain restarted, records after seq %d might have been removed", v.seq)
+	case record.Seq > expected:
+		problem(record.Seq, "records %d to %d are missing", expected, record.Seq-1)
+	case record.Seq < expected:
+		problem(record.Seq, "out of order, expected seq %d", expected)
+	case record.Prev != v.prev:
+		problem(record.Seq, "hash does not match the previous record, one of them was modified")
+	}
+
+	if record.Type == TypeCheckpoint {
+		if err := v.checkpoint(record); err != nil {
+			problem(record.Seq, "invalid checkpoint: %s", err)
+		} else {
+			v.Checkpoints++
+			v.Unsigned = 0
+		}
+	} else {
+		v.Unsigned++
+	}
+
+	v.started = true
+	v.seq = record.Seq
+	v.prev = hash(data)
+}
+
+// Helper function to check the signature of a checkpoint.
+func (v *Verifier) checkpoint(record Event) error {
+	if record.Checkpoint == nil {
+		return fmt.Errorf("signature is missing")
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(record.Checkpoint.Key))
+	if err != nil {
+		return err
+	}
+
+	if v.Key != nil && !bytes.Equal(key.Marshal(), v.Key.Marshal()) {
+		return fmt.Errorf("signed by an unknown key: %s", gossh.FingerprintSHA256(key))
+	}
+
+	err = key.Verify(checkpointData(record.Seq, record.Prev), &gossh.Signature{
+		Format: record.Checkpoint.Format,
+		Blob:   record.Checkpoint.Signature,
+	})
+	if err != nil {
+		return err
+	}
+
+	if v.Key == nil {
+		v.Key = key
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Helper function to generate a host key for signing checkpoints.
+func testSigner(t *testing.T) gossh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	signer, err := gossh.NewSignerFromKey(key)
+	assert.Nil(t, err)
+
+	return signer
+}
+
+// Helper function to verify a log, returning the messages of the problems found.
+func verify(t *testing.T, key gossh.PublicKey, lines []string) (*Verifier, []string) {
+	verifier := NewVerifier(key)
+	assert.Nil(t, verifier.Verify("audit.log", strings.NewReader(strings.Join(lines, "\n")+"\n")))
+
+	var problems []string
+	for _, problem := range verifier.Problems {
+		problems = append(problems, problem.String())
+	}
+
+	return verifier, problems
+}
+
+func TestChain(t *testing.T) {
+	signer := testSigner(t)
+
+	var buf bytes.Buffer
+
+	logger := New(nil, NewWriterSink(&buf))
+	logger.Chain(NewChain(signer), 0)
+
+	for _, command := range []string{"ls", "pwd", "whoami"} {
+		logger.Emit(Event{Type: TypeCommand, Command: command})
+	}
+
+	logger.Checkpoint()
+
+	// Checkpoints are only added when there are new events.
+	logger.Checkpoint()
+
+	logger.Emit(Event{Type: TypeCommand, Command: "id"})
+	assert.Nil(t, logger.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 6)
+
+	verifier, problems := verify(t, signer.PublicKey(), lines)
+	assert.Len(t, problems, 0)
+	assert.Equal(t, 6, verifier.Records)
+	assert.Equal(t, 2, verifier.Checkpoints)
+	assert.Equal(t, 0, verifier.Unsigned)
+
+	// A modified record no longer matches the hash in the record after it.
+	modified := append([]string{}, lines...)
+	modified[1] = strings.Replace(modified[1], "pwd", "rm -rf /", 1)
+
+	_, problems = verify(t, signer.PublicKey(), modified)
+	assert.Equal(t, []string{"audit.log:3: seq 3: hash does not match the previous record, one of them was modified"}, problems)
+
+	// Removed records leave a gap.
+	removed := append(append([]string{}, lines[:1]...), lines[2:]...)
+
+	_, problems = verify(t, signer.PublicKey(), removed)
+	assert.Equal(t, []string{"audit.log:2: seq 3: records 2 to 2 are missing"}, problems)
+
+	// Reordered records are out of sequence.
+	reordered := []string{lines[0], lines[2], lines[1], lines[3], lines[4], lines[5]}
+
+	_, problems = verify(t, signer.PublicKey(), reordered)
+	assert.Equal(t, []string{
+		"audit.log:2: seq 3: records 2 to 2 are missing",
+		"audit.log:3: seq 2: out of order, expected seq 4",
+		"audit.log:4: seq 4: records 3 to 3 are missing",
+	}, problems)
+
+	// Records can't be rewritten and signed with another key.
+	_, problems = verify(t, testSigner(t).PublicKey(), lines)
+	assert.Len(t, problems, 2)
+	assert.Contains(t, problems[0], "invalid checkpoint: signed by an unknown key")
+
+	// Without a key, checkpoints must be signed by the same key as the first one.
+	verifier, problems = verify(t, nil, lines)
+	assert.Len(t, problems, 0)
+	assert.Equal(t, signer.PublicKey().Marshal(), verifier.Key.Marshal())
+}
+
+func TestChainResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	signer := testSigner(t)
+
+	// Each run of the server continues the chain in the file.
+	for i := 0; i < 2; i++ {
+		sink, err := NewFileSink(path, 0, 0)
+		assert.Nil(t, err)
+
+		chain := NewChain(signer)
+		assert.Nil(t, chain.Resume(path))
+
+		logger := New(nil, sink)
+		logger.Chain(chain, 0)
+		// Records can be longer than the end of the file read when resuming.
+		logger.Emit(Event{Type: TypeCommand, Command: strings.Repeat("x", 3*chainTail)})
+		assert.Nil(t, logger.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+
+	verifier, problems := verify(t, signer.PublicKey(), strings.Split(strings.TrimSpace(string(data)), "\n"))
+	assert.Len(t, problems, 0)
+	assert.Equal(t, 4, verifier.Records)
+	assert.Equal(t, 2, verifier.Checkpoints)
+}
+
+func TestChainResumeRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	signer := testSigner(t)
+
+	sink, err := NewFileSink(path, 0, 0)
+	assert.Nil(t, err)
+
+	logger := New(nil, sink)
+	logger.Chain(NewChain(signer), 0)
+	logger.Emit(Event{Type: TypeCommand, Command: "ls"})
+	assert.Nil(t, logger.Close())
+
+	// The server stopped after the file was rotated, before anything was written to the new one.
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, ioutil.WriteFile(path, nil, 0600))
+
+	sink, err = NewFileSink(path, 0, 0)
+	assert.Nil(t, err)
+
+	chain := NewChain(signer)
+	assert.Nil(t, chain.Resume(path))
+
+	logger = New(nil, sink)
+	logger.Chain(chain, 0)
+	logger.Emit(Event{Type: TypeCommand, Command: "pwd"})
+	assert.Nil(t, logger.Close())
+
+	verifier := NewVerifier(signer.PublicKey())
+
+	for _, name := range []string{path + ".1", path} {
+		file, err := os.Open(name)
+		assert.Nil(t, err)
+		assert.Nil(t, verifier.Verify(name, file))
+		file.Close()
+	}
+
+	assert.Len(t, verifier.Problems, 0)
+	assert.Equal(t, 4, verifier.Records)
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// WriterSink writes events as JSON lines eg. to stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink which writes events to the writer.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{
+		w: w,
+	}
+}
+
+// Write writes the event as a line of JSON.
+func (s *WriterSink) Write(e Event) error {
+	line, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(line)
+	return err
+}
+
+// Close does nothing, the writer belongs to the caller.
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes events as JSON lines to a file, which is rotated once it reaches a size eg.
+// audit.log is moved to audit.log.1, audit.log.1 to audit.log.2 and so on.
+type FileSink struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink returns a sink which writes events to the file, keeping this many rotated files.
+// The file is never rotated if the size is zero.
+func NewFileSink(path string, maxSize int64, backups int) (*FileSink, error) {
+	s := &FileSink{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Write appends the event to the file, rotating it first if the event would not fit.
+func (s *FileSink) Write(e Event) error {
+	line, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("audit file is closed: %s", s.path)
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// Helper function to open the file for appending.
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+// Helper function to move each file along by one, dropping the oldest, and start a new file.
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	s.file = nil
+
+	if s.backups > 0 {
+		for i := s.backups - 1; i > 0; i-- {
+			err := os.Rename(backupPath(s.path, i), backupPath(s.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if err := os.Rename(s.path, backupPath(s.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+// Helper function to get the path of a rotated file, the newest is 1 eg. "audit.log.1".
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	line, err := Event{Type: TypeCommand, Command: "ls"}.Marshal()
+	assert.Nil(t, err)
+
+	// Room for two events in each file.
+	sink, err := NewFileSink(path, int64(len(line)*2), 2)
+	assert.Nil(t, err)
+
+	for i := 0; i < 7; i++ {
+		assert.Nil(t, sink.Write(Event{Type: TypeCommand, Command: "ls"}))
+	}
+
+	assert.Nil(t, sink.Close())
+
+	for file, lines := range map[string]int{"audit.log": 1, "audit.log.1": 2, "audit.log.2": 2} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Repeat(string(line), lines), string(data), file)
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Events are appended to an existing file.
+	sink, err = NewFileSink(path, int64(len(line)*2), 2)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Write(Event{Type: TypeCommand, Command: "ls"}))
+	assert.Nil(t, sink.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat(string(line), 2), string(data))
+
+	assert.NotNil(t, sink.Write(Event{Type: TypeCommand}))
+}
@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Events are logged with the security/authorization facility.
+	syslogFacility = 10
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+
+	// RFC 5424 timestamps, with up to microsecond precision.
+	syslogTimestamp = "2006-01-02T15:04:05.999999Z07:00"
+
+	// RFC 5424 requires UTF-8 messages to start with a byte order mark.
+	syslogBOM = "\xef\xbb\xbf"
+
+	// How long connecting or sending an event can take, events are written while holding the
+	// logger's lock so a server which stops responding must not hold up authentication.
+	syslogTimeout = 5 * time.Second
+)
+
+// SyslogSink sends events to a syslog server in the RFC 5424 format, with the event as the message.
+type SyslogSink struct {
+	network  string
+	address  string
+	hostname string
+	appName  string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogSink returns a sink which sends events to the address eg. udp://syslog:514,
+// tcp://syslog:601, tls://syslog:6514 or unix:///dev/log.
+func NewSyslogSink(address, appName string) (*SyslogSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SyslogSink{
+		network: u.Scheme,
+		address: u.Host,
+		appName: appName,
+		timeout: syslogTimeout,
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	case "unix":
+		s.network, s.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog address: %s", address)
+	}
+
+	s.hostname, err = os.Hostname()
+	if err != nil {
+		s.hostname = "-"
+	}
+
+	return s, nil
+}
+
+// Write sends the event, reconnecting once if the connection has been lost.
+func (s *SyslogSink) Write(e Event) error {
+	msg, err := s.format(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				return err
+			}
+
+			s.conn = conn
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+
+		_, err = s.conn.Write(msg)
+		if err == nil || attempt > 0 {
+			return err
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close closes the connection to the server.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
+
+// Helper function to connect to the server.
+func (s *SyslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: s.timeout,
+	}
+
+	if s.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.address, nil)
+	}
+
+	return dialer.Dial(s.network, s.address)
+}
+
+// Helper function to format the event as a syslog message eg.
+// "<86>1 2006-01-02T15:04:05Z host k8s-ssh 1234 session.start - {...}". Messages sent over a
+// stream are prefixed with their length (RFC 6587 octet counting).
+func (s *SyslogSink) format(e Event) ([]byte, error) {
+	body, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	severity := syslogSeverityInfo
+	if e.Success != nil && !*e.Success {
+		severity = syslogSeverityWarning
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s%s", syslogFacility*8+severity, e.Time.UTC().Format(syslogTimestamp), s.hostname, s.appName, os.Getpid(), e.Type, syslogBOM, body[:len(body)-1])
+
+	if s.network == "tcp" || s.network == "tls" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	return []byte(msg), nil
+}
@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp://"+conn.LocalAddr().String(), "k8s-ssh")
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	sink.hostname = "gateway"
+
+	err = sink.Write(Event{
+		Type:    TypeAuthResult,
+		Time:    time.Date(2018, 1, 2, 3, 4, 5, 6000, time.UTC),
+		User:    "nick",
+		Success: Bool(false),
+	})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	expected := fmt.Sprintf("<84>1 2018-01-02T03:04:05.000006Z gateway k8s-ssh %d auth.result - \xef\xbb\xbf{\"type\":\"auth.result\",\"time\":\"2018-01-02T03:04:05.000006Z\",\"user\":\"nick\",\"success\":false}", os.Getpid())
+	assert.Equal(t, expected, string(buf[:n]))
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	messages := make(chan string)
+
+	// Accept connections one after the other, so the sink has to reconnect.
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+
+			var length int
+			fmt.Fscanf(r, "%d ", &length)
+
+			msg := make([]byte, length)
+			io.ReadFull(r, msg)
+			conn.Close()
+
+			messages <- string(msg)
+		}
+	}()
+
+	sink, err := NewSyslogSink("tcp://"+l.Addr().String(), "k8s-ssh")
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	assert.Nil(t, sink.Write(Event{Type: TypeSessionStart}))
+	assert.Contains(t, <-messages, " session.start - ")
+
+	// Give the server time to close the connection.
+	time.Sleep(100 * time.Millisecond)
+
+	// The first write may not notice the connection was closed, keep going until one arrives.
+	go func() {
+		for i := 0; i < 10; i++ {
+			if sink.Write(Event{Type: TypeSessionEnd}) != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	assert.Contains(t, <-messages, " session.end - ")
+
+	_, err = NewSyslogSink("http://syslog", "k8s-ssh")
+	assert.NotNil(t, err)
+}
+
+func TestSyslogSinkTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	// Accept the connection but never complete the TLS handshake.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	sink, err := NewSyslogSink("tls://"+l.Addr().String(), "k8s-ssh")
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	sink.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	assert.NotNil(t, sink.Write(Event{Type: TypeAuthResult}))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
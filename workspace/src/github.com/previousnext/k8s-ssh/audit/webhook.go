@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ErrQueueFull is returned when events are emitted faster than they can be delivered.
+var ErrQueueFull = errors.New("audit webhook queue is full, the event was dropped")
+
+const (
+	// How many batches can be waiting to be sent before events are dropped.
+	webhookQueueBatches = 10
+	// How many times a batch is sent before it is dropped.
+	webhookAttempts = 5
+	// How long to wait before sending a batch again, doubled after each attempt.
+	webhookBackoff = time.Second
+)
+
+// WebhookSink sends events to a URL in batches, as a JSON array in the body of a POST. Batches
+// are sent again if the request fails.
+type WebhookSink struct {
+	url      string
+	client   *http.Client
+	size     int
+	interval time.Duration
+	backoff  time.Duration
+	failure  func(error)
+
+	queue chan Event
+	done  chan struct{}
+}
+
+// NewWebhookSink returns a sink which sends batches of up to size events to the URL, waiting
+// up to the interval for a batch to fill. Batches which could not be delivered are passed to
+// the function.
+func NewWebhookSink(url string, size int, interval time.Duration, failure func(error)) *WebhookSink {
+	if size < 1 {
+		size = 1
+	}
+
+	s := &WebhookSink{
+		url: url,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		size:     size,
+		interval: interval,
+		backoff:  webhookBackoff,
+		failure:  failure,
+		queue:    make(chan Event, size*webhookQueueBatches),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Write queues the event to be sent with the next batch.
+func (s *WebhookSink) Write(e Event) error {
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close sends the events which are still queued.
+func (s *WebhookSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return nil
+}
+
+// Helper function to batch up events until the sink is closed.
+func (s *WebhookSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var batch []Event
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := s.send(batch); err != nil && s.failure != nil {
+			s.failure(fmt.Errorf("failed to send %d audit events: %s", len(batch), err))
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case e, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) >= s.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Helper function to send a batch, retrying server errors and failed connections.
+func (s *WebhookSink) send(batch []Event) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	backoff := s.backoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Helper function to post a batch, returning if it is worth sending again.
+func (s *WebhookSink) post(body []byte) (bool, error) {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
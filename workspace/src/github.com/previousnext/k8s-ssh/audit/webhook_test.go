@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		batches  [][]Event
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+
+		// Fail the first request, so the batch is sent again.
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var batch []Event
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&batch))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		batches = append(batches, batch)
+	}))
+	defer server.Close()
+
+	var failures []error
+
+	sink := NewWebhookSink(server.URL, 2, time.Hour, func(err error) {
+		failures = append(failures, err)
+	})
+	sink.backoff = time.Millisecond
+
+	for _, command := range []string{"ls", "pwd", "whoami"} {
+		assert.Nil(t, sink.Write(Event{Type: TypeCommand, Command: command}))
+	}
+
+	// The last batch is only partly full, it is sent when the sink is closed.
+	assert.Nil(t, sink.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	assert.Len(t, failures, 0)
+	assert.Equal(t, 3, requests)
+	assert.Len(t, batches, 2)
+	assert.Equal(t, "ls", batches[0][0].Command)
+	assert.Equal(t, "pwd", batches[0][1].Command)
+	assert.Equal(t, "whoami", batches[1][0].Command)
+}
+
+func TestWebhookSinkRejected(t *testing.T) {
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	var failures []error
+
+	sink := NewWebhookSink(server.URL, 10, time.Hour, func(err error) {
+		failures = append(failures, err)
+	})
+
+	assert.Nil(t, sink.Write(Event{Type: TypeCommand}))
+	assert.Nil(t, sink.Close())
+
+	// Requests which were rejected are not sent again.
+	assert.Equal(t, 1, requests)
+	assert.Len(t, failures, 1)
+}
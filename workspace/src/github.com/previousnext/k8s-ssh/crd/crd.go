@@ -45,6 +45,22 @@ func Create(clientset apiextcs.Interface) error {
 	return err
 }
 
+// Established returns true once the API server is serving the CRD resource.
+func Established(clientset apiextcs.Interface) (bool, error) {
+	definition, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(FullCRDName, meta_v1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	for _, condition := range definition.Status.Conditions {
+		if condition.Type == apiextv1beta1.Established && condition.Status == apiextv1beta1.ConditionTrue {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // Definition of our CRD Example class
 type SshUser struct {
 	meta_v1.TypeMeta   `json:",inline"`
@@ -54,6 +70,9 @@ type SshUser struct {
 type SshUserSpec struct {
 	Groups         []string `json:"groups"`
 	AuthorizedKeys []string `json:"authorizedKeys"`
+
+	// Overrides the namespace policy for forwarding the user's agent, if set.
+	AgentForwarding *bool `json:"agentForwarding,omitempty"`
 }
 
 type SshUserList struct {
@@ -0,0 +1,206 @@
+package recording
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalStorage stores recordings in a directory.
+type LocalStorage struct {
+	dir string
+
+	mu   sync.Mutex
+	open map[string]bool
+}
+
+// NewLocalStorage returns storage which writes recordings to the directory.
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{
+		dir:  dir,
+		open: make(map[string]bool),
+	}
+}
+
+// Create returns a new file for the recording.
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.open[path] = true
+	s.mu.Unlock()
+
+	return &localFile{
+		File: file,
+		closed: func() {
+			s.mu.Lock()
+			delete(s.open, path)
+			s.mu.Unlock()
+		},
+	}, nil
+}
+
+// Prune removes recordings last modified before the time. Recordings which are still being
+// written are never removed.
+func (s *LocalStorage) Prune(before time.Time) (int, error) {
+	files, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+
+	for _, f := range files {
+		if f.open || !f.modified.Before(before) {
+			continue
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// A recording on disk.
+type localRecording struct {
+	path     string
+	size     int64
+	modified time.Time
+	open     bool
+}
+
+// Helper function to list the recordings, oldest first.
+func (s *LocalStorage) list() ([]localRecording, error) {
+	var files []localRecording
+
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, Extension) {
+			return nil
+		}
+
+		s.mu.Lock()
+		open := s.open[path]
+		s.mu.Unlock()
+
+		files = append(files, localRecording{path, info.Size(), info.ModTime(), open})
+
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modified.Before(files[j].modified)
+	})
+
+	return files, err
+}
+
+// A recording file which tells the storage when it has been closed.
+type localFile struct {
+	*os.File
+	closed func()
+}
+
+func (f *localFile) Close() error {
+	defer f.closed()
+	return f.File.Close()
+}
+
+// VolumeStorage stores recordings in a directory with a size limit eg. a mounted
+// PersistentVolumeClaim. The oldest recordings are removed to stay under the limit.
+type VolumeStorage struct {
+	*LocalStorage
+	maxSize int64
+}
+
+// NewVolumeStorage returns storage which keeps the recordings in the directory under the size.
+func NewVolumeStorage(dir string, maxSize int64) *VolumeStorage {
+	return &VolumeStorage{
+		LocalStorage: NewLocalStorage(dir),
+		maxSize:      maxSize,
+	}
+}
+
+// Create makes room for the recording and returns a new file for it. Room is made again
+// once it is closed.
+func (s *VolumeStorage) Create(name string) (io.WriteCloser, error) {
+	if _, err := s.Rotate(); err != nil {
+		return nil, err
+	}
+
+	w, err := s.LocalStorage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file := w.(*localFile)
+	closed := file.closed
+
+	file.closed = func() {
+		closed()
+		s.Rotate()
+	}
+
+	return file, nil
+}
+
+// Rotate removes the oldest recordings until they fit within the size limit, returning how
+// many were removed. Recordings which are still being written count towards the limit, but
+// are never removed.
+func (s *VolumeStorage) Rotate() (int, error) {
+	files, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+
+	for _, f := range files {
+		total += f.size
+	}
+
+	var removed int
+
+	for _, f := range files {
+		if total <= s.maxSize {
+			break
+		}
+
+		if f.open {
+			continue
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			return removed, err
+		}
+
+		total -= f.size
+		removed++
+	}
+
+	return removed, nil
+}
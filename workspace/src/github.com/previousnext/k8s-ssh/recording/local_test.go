@@ -0,0 +1,74 @@
+package recording
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewLocalStorage(dir)
+
+	w, err := storage.Create("foo/old.cast")
+	assert.Nil(t, err)
+	w.Write([]byte("old"))
+	assert.Nil(t, w.Close())
+
+	// Recordings are never overwritten.
+	_, err = storage.Create("foo/old.cast")
+	assert.NotNil(t, err)
+
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "foo", "old.cast"), old, old))
+
+	open, err := storage.Create("foo/open.cast")
+	assert.Nil(t, err)
+
+	// Recordings still being written are kept, even if they are old.
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "foo", "open.cast"), old, old))
+
+	removed, err := storage.Prune(time.Now().Add(-24 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	_, err = os.Stat(filepath.Join(dir, "foo", "old.cast"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, open.Close())
+}
+
+func TestVolumeStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewVolumeStorage(dir, 25)
+
+	for i, name := range []string{"a", "b", "c"} {
+		w, err := storage.Create("foo/" + name + ".cast")
+		assert.Nil(t, err)
+		w.Write([]byte(strings.Repeat(name, 10)))
+		assert.Nil(t, w.Close())
+
+		modified := time.Now().Add(time.Duration(i-10) * time.Minute)
+		assert.Nil(t, os.Chtimes(filepath.Join(dir, "foo", name+".cast"), modified, modified))
+	}
+
+	// The oldest recording was removed when the last one was closed.
+	removed, err := storage.Rotate()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+
+	files, err := filepath.Glob(filepath.Join(dir, "foo", "*.cast"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "foo", "b.cast"), filepath.Join(dir, "foo", "c.cast")}, files)
+}
@@ -0,0 +1,238 @@
+// Package recording records terminal sessions in the asciicast v2 format, which can be played
+// back with asciinema eg. "asciinema play session.cast".
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Version of the asciicast format.
+const Version = 2
+
+// Extension used for recordings.
+const Extension = ".cast"
+
+// Event types.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Header is the first line of a recording.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+
+	// Who was connected and where, players ignore fields they do not know about.
+	Session Session `json:"session"`
+}
+
+// Session describes who was connected and where.
+type Session struct {
+	ID          string `json:"id"`
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+	Namespace   string `json:"namespace"`
+	Pod         string `json:"pod"`
+	Container   string `json:"container"`
+	RemoteAddr  string `json:"remoteAddr"`
+}
+
+// Recorder writes events to a recording, it is safe to use from multiple goroutines.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	start   time.Time
+	pending map[string][]byte
+	err     error
+	failed  chan struct{}
+}
+
+// New writes the header and returns a recorder which times events from now.
+func New(w io.WriteCloser, header Header) (*Recorder, error) {
+	start := time.Now()
+
+	header.Version = Version
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		w:       w,
+		start:   start,
+		pending: make(map[string][]byte),
+		failed:  make(chan struct{}),
+	}, nil
+}
+
+// Output records data written to the terminal.
+func (r *Recorder) Output(p []byte) {
+	r.data(EventOutput, p)
+}
+
+// Input records data typed by the user.
+func (r *Recorder) Input(p []byte) {
+	r.data(EventInput, p)
+}
+
+// Resize records the terminal changing size.
+func (r *Recorder) Resize(width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.write(EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Writer returns a writer which records everything written to w as output.
+func (r *Recorder) Writer(w io.Writer) io.Writer {
+	return &recordingWriter{w, r}
+}
+
+// Reader returns a reader which records everything read from rd as input.
+func (r *Recorder) Reader(rd io.Reader) io.Reader {
+	return &recordingReader{rd, r}
+}
+
+// Failed returns a channel which is closed once an event could not be written, nothing is
+// recorded after that.
+func (r *Recorder) Failed() <-chan struct{} {
+	return r.failed
+}
+
+// Close closes the recording, returning the first error which stopped events being written.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Close(); err != nil {
+		r.fail(err)
+	}
+
+	return r.err
+}
+
+// Helper function to record data. Events must be valid UTF-8, so a character which is split
+// across writes is held back until the rest of it arrives.
+func (r *Recorder) data(typ string, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending[typ], p...)
+
+	n := incomplete(data)
+	r.pending[typ] = append([]byte(nil), data[len(data)-n:]...)
+	data = data[:len(data)-n]
+
+	if len(data) > 0 {
+		r.write(typ, string(data))
+	}
+}
+
+// Helper function to write an event eg. [1.250000, "o", "hello"]. The lock must be held.
+func (r *Recorder) write(typ, data string) {
+	if r.err != nil {
+		return
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+
+	elapsed := strconv.FormatFloat(time.Since(r.start).Seconds(), 'f', 6, 64)
+
+	line := make([]byte, 0, len(elapsed)+len(typ)+len(encoded)+8)
+	line = append(line, '[')
+	line = append(line, elapsed...)
+	line = append(line, ", \""...)
+	line = append(line, typ...)
+	line = append(line, "\", "...)
+	line = append(line, encoded...)
+	line = append(line, "]\n"...)
+
+	if _, err := r.w.Write(line); err != nil {
+		r.fail(err)
+	}
+}
+
+// Helper function to keep the first error which stopped events being written. The lock must be held.
+func (r *Recorder) fail(err error) {
+	if r.err != nil {
+		return
+	}
+
+	r.err = err
+	close(r.failed)
+}
+
+// Helper function to get the length of an incomplete UTF-8 character at the end of the data.
+func incomplete(p []byte) int {
+	// A character is at most 4 bytes, so only the last 3 bytes can be the start of an incomplete one.
+	for i := 1; i <= 3 && i <= len(p); i++ {
+		c := p[len(p)-i]
+
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return i
+			}
+
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// Records output as it is written.
+type recordingWriter struct {
+	w io.Writer
+	r *Recorder
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.r.Output(p[:n])
+	}
+
+	return n, err
+}
+
+// Records input as it is read.
+type recordingReader struct {
+	rd io.Reader
+	r  *Recorder
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		r.r.Input(p[:n])
+	}
+
+	return n, err
+}
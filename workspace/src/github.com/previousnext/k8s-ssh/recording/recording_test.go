@@ -0,0 +1,145 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A buffer which can be closed.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRecorder(t *testing.T) {
+	var buf closeBuffer
+
+	r, err := New(&buf, Header{
+		Width:  80,
+		Height: 24,
+		Env:    map[string]string{"TERM": "xterm"},
+		Session: Session{
+			ID:          "abc123",
+			User:        "nick",
+			Fingerprint: "SHA256:xyz",
+			Namespace:   "foo",
+			Pod:         "bar",
+			Container:   "baz",
+			RemoteAddr:  "127.0.0.1:1234",
+		},
+	})
+	assert.Nil(t, err)
+
+	w := r.Writer(ioutil.Discard)
+	w.Write([]byte("$ "))
+
+	rd := r.Reader(strings.NewReader("ls\r"))
+	ioutil.ReadAll(rd)
+
+	r.Resize(100, 30)
+
+	// A character split across writes is recorded once it is complete.
+	w.Write([]byte{0xe2, 0x9c})
+	w.Write([]byte{0x93, '\n'})
+
+	assert.Nil(t, r.Close())
+	assert.True(t, buf.closed)
+
+	scanner := bufio.NewScanner(&buf.Buffer)
+
+	assert.True(t, scanner.Scan())
+
+	var header Header
+	assert.Nil(t, json.Unmarshal(scanner.Bytes(), &header))
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, 80, header.Width)
+	assert.Equal(t, 24, header.Height)
+	assert.NotZero(t, header.Timestamp)
+	assert.Equal(t, "nick", header.Session.User)
+	assert.Equal(t, "SHA256:xyz", header.Session.Fingerprint)
+	assert.Equal(t, "127.0.0.1:1234", header.Session.RemoteAddr)
+
+	var events [][]interface{}
+
+	for scanner.Scan() {
+		var event []interface{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+
+	assert.Len(t, events, 4)
+
+	for i, expected := range [][]string{
+		{EventOutput, "$ "},
+		{EventInput, "ls\r"},
+		{EventResize, "100x30"},
+		{EventOutput, "✓\n"},
+	} {
+		assert.IsType(t, float64(0), events[i][0])
+		assert.Equal(t, expected[0], events[i][1])
+		assert.Equal(t, expected[1], events[i][2])
+	}
+}
+
+// A writer which fails once the header has been written, like an upload to an object store which failed.
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("upload failed")
+	}
+
+	return len(p), nil
+}
+
+func (w *failingWriter) Close() error {
+	return nil
+}
+
+func TestRecorderFailed(t *testing.T) {
+	r, err := New(&failingWriter{}, Header{Width: 80, Height: 24})
+	assert.Nil(t, err)
+
+	select {
+	case <-r.Failed():
+		t.Fatal("recorder failed before an event could not be written")
+	default:
+	}
+
+	r.Writer(ioutil.Discard).Write([]byte("$ "))
+
+	select {
+	case <-r.Failed():
+	default:
+		t.Fatal("recorder did not fail when an event could not be written")
+	}
+
+	// Later events do not close the channel again.
+	r.Resize(100, 30)
+
+	assert.EqualError(t, r.Close(), "upload failed")
+}
+
+func TestIncomplete(t *testing.T) {
+	assert.Equal(t, 0, incomplete([]byte("abc")))
+	assert.Equal(t, 0, incomplete([]byte("✓")))
+	assert.Equal(t, 1, incomplete([]byte{'a', 0xe2}))
+	assert.Equal(t, 2, incomplete([]byte{'a', 0xe2, 0x9c}))
+	assert.Equal(t, 3, incomplete([]byte{0xf0, 0x9f, 0x98}))
+	assert.Equal(t, 0, incomplete(nil))
+}
@@ -0,0 +1,553 @@
+package recording
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Smallest part S3 accepts in a multipart upload, other than the last part.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// How many times a request is attempted before an upload fails.
+const s3Attempts = 3
+
+// How long a request can take, including uploading a part, when the default client is used.
+const s3Timeout = time.Minute
+
+// How many parts can wait to be uploaded, once the queue is full the recording fails rather
+// than holding up the session.
+const s3QueuedParts = 4
+
+// S3Config configures an S3 compatible object store eg. AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint of the object store eg. "https://s3.ap-southeast-2.amazonaws.com" or "http://minio:9000".
+	// Buckets are addressed with the path eg. "<endpoint>/<bucket>/<key>".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+
+	// Output is uploaded in parts of this size as it is recorded, defaults to 5MiB.
+	PartSize int
+
+	// Client used for requests, defaults to a client which times out after a minute.
+	Client *http.Client
+}
+
+// S3Storage streams recordings to an S3 compatible object store with multipart uploads, so
+// recordings are never buffered on disk.
+type S3Storage struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3Storage returns storage which uploads recordings to the bucket.
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("an endpoint and bucket are required")
+	}
+
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	if config.PartSize <= 0 {
+		config.PartSize = s3MinPartSize
+	}
+
+	client := config.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout: s3Timeout,
+		}
+	}
+
+	return &S3Storage{
+		config: config,
+		client: client,
+		now:    time.Now,
+	}, nil
+}
+
+// Create returns a writer which uploads the recording in parts as it is written. Recordings
+// smaller than a part are uploaded with a single request when they are closed.
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	u := &s3Upload{
+		storage: s,
+		key:     s.config.Prefix + name,
+		parts:   make(chan s3Part, s3QueuedParts),
+		done:    make(chan struct{}),
+	}
+
+	go u.upload()
+
+	return u, nil
+}
+
+// Prune removes recordings last modified before the time.
+func (s *S3Storage) Prune(before time.Time) (int, error) {
+	var (
+		removed int
+		token   string
+	)
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.config.Prefix},
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result s3ListResult
+
+		if err := s.do("GET", "", query, nil, &result); err != nil {
+			return removed, err
+		}
+
+		for _, object := range result.Contents {
+			if !strings.HasSuffix(object.Key, Extension) || !object.LastModified.Before(before) {
+				continue
+			}
+
+			if err := s.do("DELETE", object.Key, nil, nil, nil); err != nil {
+				return removed, err
+			}
+
+			removed++
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return removed, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// Response to a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Response to a CreateMultipartUpload request.
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// Body of a CompleteMultipartUpload request.
+type s3CompleteRequest struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Error returned by the object store.
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// A part of a recording waiting to be uploaded.
+type s3Part struct {
+	data []byte
+	last bool
+}
+
+// An upload which is in progress.
+type s3Upload struct {
+	storage *S3Storage
+	key     string
+
+	buf   []byte
+	parts chan s3Part
+	done  chan struct{}
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// Write buffers the data, handing each full part to be uploaded in the background. It never
+// waits for the object store, the upload fails if too many parts are waiting.
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if err := u.error(); err != nil {
+		return 0, err
+	}
+
+	u.buf = append(u.buf, p...)
+
+	for len(u.buf) >= u.storage.config.PartSize {
+		part := make([]byte, u.storage.config.PartSize)
+		copy(part, u.buf)
+		u.buf = append(u.buf[:0], u.buf[len(part):]...)
+
+		select {
+		case u.parts <- s3Part{data: part}:
+		default:
+			u.fail(fmt.Errorf("%d parts are already waiting to be uploaded", s3QueuedParts))
+			return 0, u.error()
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close uploads what is left and completes the upload.
+func (u *s3Upload) Close() error {
+	if u.closed {
+		return u.error()
+	}
+
+	u.closed = true
+
+	if u.error() == nil {
+		select {
+		case u.parts <- s3Part{data: u.buf, last: true}:
+		case <-u.done:
+		}
+	}
+
+	close(u.parts)
+	<-u.done
+
+	return u.error()
+}
+
+// Helper function to upload the parts as they are written.
+func (u *s3Upload) upload() {
+	defer close(u.done)
+
+	var (
+		uploadID string
+		parts    []s3CompletedPart
+	)
+
+	for part := range u.parts {
+		// Parts which are still queued once the upload has failed are dropped.
+		if u.error() != nil {
+			break
+		}
+
+		// Recordings which fit in a single part do not need a multipart upload.
+		if part.last && uploadID == "" {
+			u.fail(u.storage.do("PUT", u.key, nil, part.data, nil))
+			return
+		}
+
+		if uploadID == "" {
+			var result s3InitiateResult
+
+			if err := u.storage.do("POST", u.key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+				u.fail(err)
+				return
+			}
+
+			uploadID = result.UploadID
+		}
+
+		number := len(parts) + 1
+
+		etag, err := u.storage.put(u.key, url.Values{
+			"partNumber": {fmt.Sprint(number)},
+			"uploadId":   {uploadID},
+		}, part.data)
+		if err != nil {
+			u.abort(uploadID)
+			u.fail(err)
+			return
+		}
+
+		parts = append(parts, s3CompletedPart{number, etag})
+
+		if part.last {
+			u.complete(uploadID, parts)
+			return
+		}
+	}
+
+	if uploadID != "" {
+		u.abort(uploadID)
+	}
+}
+
+// Helper function to complete a multipart upload once every part has been uploaded.
+func (u *s3Upload) complete(uploadID string, parts []s3CompletedPart) {
+	body, err := xml.Marshal(s3CompleteRequest{Parts: parts})
+	if err != nil {
+		u.abort(uploadID)
+		u.fail(err)
+		return
+	}
+
+	if err := u.storage.do("POST", u.key, url.Values{"uploadId": {uploadID}}, body, nil); err != nil {
+		u.abort(uploadID)
+		u.fail(err)
+	}
+}
+
+// Helper function to give up on an upload, so the parts are not kept by the object store.
+func (u *s3Upload) abort(uploadID string) {
+	u.storage.do("DELETE", u.key, url.Values{"uploadId": {uploadID}}, nil, nil)
+}
+
+// Helper function to record the error which stopped the upload.
+func (u *s3Upload) fail(err error) {
+	if err == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err == nil {
+		u.err = fmt.Errorf("failed to upload %s: %s", u.key, err)
+	}
+}
+
+// Helper function to get the error which stopped the upload.
+func (u *s3Upload) error() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.err
+}
+
+// Helper function to upload data, returning its ETag.
+func (s *S3Storage) put(key string, query url.Values, data []byte) (string, error) {
+	resp, err := s.request("PUT", key, query, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// Helper function to send a request, decoding the XML response into result if it is not nil.
+func (s *S3Storage) do(method, key string, query url.Values, body []byte, result interface{}) error {
+	resp, err := s.request(method, key, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+// Helper function to send a signed request, retrying server errors.
+func (s *S3Storage) request(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	var err error
+
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		var req *http.Request
+
+		req, err = http.NewRequest(method, s.url(key, query), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		s.sign(req, body)
+
+		var resp *http.Response
+
+		resp, err = s.client.Do(req)
+		if err != nil {
+			continue
+		}
+
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		err = responseError(resp)
+		resp.Body.Close()
+
+		// Client errors will fail again.
+		if resp.StatusCode < 500 {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// Helper function to build the URL for a key in the bucket.
+func (s *S3Storage) url(key string, query url.Values) string {
+	u := strings.TrimRight(s.config.Endpoint, "/") + "/" + uriEncode(s.config.Bucket, false)
+
+	if key != "" {
+		u += "/" + uriEncode(key, false)
+	}
+
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+
+	return u
+}
+
+// Helper function to sign a request with AWS Signature Version 4.
+func (s *S3Storage) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	scope := strings.Join([]string{date, s.config.Region, "s3", "aws4_request"}, "/")
+
+	headers, signed := canonicalHeaders(req)
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		headers,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonical))
+
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.config.AccessKey, scope, signed, signature))
+}
+
+// Helper function to build the canonical headers and the list of signed headers. The host
+// and every header set on the request are signed.
+func canonicalHeaders(req *http.Request) (string, string) {
+	values := map[string]string{
+		"host": req.URL.Host,
+	}
+
+	for name, v := range req.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	var names []string
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var headers string
+
+	for _, name := range names {
+		headers += name + ":" + values[name] + "\n"
+	}
+
+	return headers, strings.Join(names, ";")
+}
+
+// Helper function to encode a query string with the keys sorted, as required for signing.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+
+	for key := range query {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var params []string
+
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// Helper function to encode a string as specified for signing, leaving slashes as they are
+// unless encodeSlash is set.
+func uriEncode(value string, encodeSlash bool) string {
+	var b bytes.Buffer
+
+	for _, c := range []byte(value) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// Helper function to calculate a HMAC-SHA256.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Helper function to read the error from a response.
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var e s3Error
+
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("%s: %s", e.Code, e.Message)
+	}
+
+	return fmt.Errorf("unexpected status: %s", resp.Status)
+}
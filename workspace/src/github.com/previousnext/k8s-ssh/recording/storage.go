@@ -0,0 +1,16 @@
+package recording
+
+import (
+	"io"
+	"time"
+)
+
+// Storage stores recordings.
+type Storage interface {
+	// Create returns a writer for a new recording eg. "namespace/session.cast", which is
+	// stored once it is closed.
+	Create(name string) (io.WriteCloser, error)
+
+	// Prune removes recordings last modified before the time, returning how many were removed.
+	Prune(before time.Time) (int, error)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/previousnext/k8s-ssh/agent"
+)
+
+// Channel opened to the client for each connection to the forwarded agent.
+const agentChannel = "auth-agent@openssh.com"
+
+// How long to wait for the relay to start listening in the container.
+const agentRelayTimeout = 15 * time.Second
+
+// Script which installs the relay from stdin into a new directory only the user running it
+// can write to, printing the path of the relay.
+const agentRelayInstall = `dir=$(mktemp -d /tmp/.k8s-ssh-XXXXXXXXXX) && chmod 700 "$dir" && cat > "$dir/k8s-ssh" && chmod 700 "$dir/k8s-ssh" && echo "$dir/k8s-ssh"`
+
+// Script which checks the relay is still in a directory only the user can write to, and
+// that it is the same build as the gateway.
+const agentRelayVerify = `[ "$(stat -c %u:%a "${1%/*}")" = "$(id -u):700" ] && [ "$(sha256sum "$1" | cut -d " " -f 1)" = "$2" ]`
+
+// AgentForwarder forwards the client's agent (ssh -A) into containers. The gateway binary
+// is copied into the container and run as a relay, which listens on a socket and sends
+// connections back over the exec to be opened as agent channels on the client.
+type AgentForwarder struct {
+	once     sync.Once
+	binary   string
+	checksum string
+	err      error
+
+	mu sync.Mutex
+	// Path of the relay installed in each container, keyed by the exec URL of the container.
+	relays map[string]string
+}
+
+// NewAgentForwarder returns a forwarder which installs the gateway binary as the relay.
+func NewAgentForwarder() *AgentForwarder {
+	return &AgentForwarder{
+		relays: make(map[string]string),
+	}
+}
+
+// Forward starts a relay in the container, returning the path of the socket to use as
+// SSH_AUTH_SOCK. The relay is stopped when the context is cancelled.
+func (a *AgentForwarder) Forward(ctx context.Context, sess ssh.Session, runner *PodRunner, id string) (string, error) {
+	conn, ok := sess.Context().Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return "", fmt.Errorf("connection not found")
+	}
+
+	relay, err := a.install(runner)
+	if err != nil {
+		return "", fmt.Errorf("failed to install the agent relay: %s", err)
+	}
+
+	socket := agentSocket(id)
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	go func() {
+		err := runner.Run([]string{relay, cmdAgentRelay.FullCommand(), socket}, stdinR, stdoutW, ioutil.Discard)
+		stdoutW.CloseWithError(err)
+	}()
+
+	// Closing stdin tells the relay to remove the socket and exit.
+	go func() {
+		<-ctx.Done()
+		stdinW.Close()
+	}()
+
+	dial := func() (io.ReadWriteCloser, error) {
+		ch, reqs, err := conn.OpenChannel(agentChannel, nil)
+		if err != nil {
+			return nil, err
+		}
+		go gossh.DiscardRequests(reqs)
+
+		return ch, nil
+	}
+
+	ready := make(chan struct{})
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- agent.Serve(stdoutR, stdinW, dial, func() { close(ready) })
+	}()
+
+	select {
+	case <-ready:
+		return socket, nil
+	case err := <-errs:
+		return "", err
+	case <-time.After(agentRelayTimeout):
+		stdinW.Close()
+		return "", fmt.Errorf("timed out waiting for the agent relay")
+	}
+}
+
+// Helper function to copy the gateway binary into the container, unless a copy of the
+// same build is already there, returning its path. The relay is checked against the
+// checksum of the gateway binary before it is used.
+func (a *AgentForwarder) install(runner *PodRunner) (string, error) {
+	a.once.Do(func() {
+		a.binary, a.checksum, a.err = executableChecksum()
+	})
+
+	if a.err != nil {
+		return "", a.err
+	}
+
+	container := runner.Container()
+
+	a.mu.Lock()
+	path, ok := a.relays[container]
+	a.mu.Unlock()
+
+	if ok && a.verify(runner, path) == nil {
+		return path, nil
+	}
+
+	file, err := os.Open(a.binary)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var stdout bytes.Buffer
+
+	err = runner.Run([]string{"sh", "-c", agentRelayInstall}, file, &stdout, ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+
+	path = strings.TrimSpace(stdout.String())
+
+	if err := a.verify(runner, path); err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	a.relays[container] = path
+	a.mu.Unlock()
+
+	return path, nil
+}
+
+// Helper function to check the relay in the container matches the gateway binary.
+func (a *AgentForwarder) verify(runner *PodRunner, path string) error {
+	err := runner.Run([]string{"sh", "-c", agentRelayVerify, "sh", path, a.checksum}, nil, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("the relay at %s does not match the gateway binary", path)
+	}
+
+	return nil
+}
+
+// Helper function to find the running binary and its checksum.
+func executableChecksum() (string, string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", "", err
+	}
+
+	return path, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Helper function to get the path of the agent socket for a session, in a directory only
+// the user running the relay can access.
+func agentSocket(id string) string {
+	return fmt.Sprintf("/tmp/.k8s-ssh-agent-%s/agent.sock", id)
+}
+
+// Helper function to run the relay inside a container, until stdin is closed.
+func runAgentRelay(socket string) error {
+	dir := filepath.Dir(socket)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	return agent.Relay(listener, os.Stdin, os.Stdout)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	promlog "github.com/prometheus/common/log"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/previousnext/k8s-ssh/audit"
+)
+
+// Name the gateway logs to syslog as.
+const auditAppName = "k8s-ssh"
+
+// AuditConfig selects where audit events are sent, each destination is disabled if left empty.
+type AuditConfig struct {
+	Stdout bool
+
+	File        string
+	FileMaxSize int64
+	FileBackups int
+
+	Syslog string
+
+	Webhook         string
+	WebhookBatch    int
+	WebhookInterval time.Duration
+
+	// Link the events in a hash chain, with checkpoints signed by the host key.
+	Chain              bool
+	Signer             gossh.Signer
+	CheckpointInterval time.Duration
+}
+
+// Helper function to build the audit logger from the config.
+func newAuditor(config AuditConfig) (*audit.Logger, error) {
+	failure := func(err error) {
+		promlog.Info("Failed to deliver audit event:", err)
+	}
+
+	var sinks []audit.Sink
+
+	if config.Stdout {
+		sinks = append(sinks, audit.NewWriterSink(os.Stdout))
+	}
+
+	if config.File != "" {
+		sink, err := audit.NewFileSink(config.File, config.FileMaxSize, config.FileBackups)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	if config.Syslog != "" {
+		sink, err := audit.NewSyslogSink(config.Syslog, auditAppName)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	if config.Webhook != "" {
+		sinks = append(sinks, audit.NewWebhookSink(config.Webhook, config.WebhookBatch, config.WebhookInterval, failure))
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	logger := audit.New(failure, sinks...)
+
+	if config.Chain {
+		if config.Signer == nil {
+			return nil, fmt.Errorf("a host key must be set with --signer to sign audit checkpoints")
+		}
+
+		chain := audit.NewChain(config.Signer)
+
+		// The file is appended to by each run of the server, so it is kept as one chain.
+		if config.File != "" {
+			if err := chain.Resume(config.File); err != nil {
+				promlog.Info("Failed to continue the audit chain, starting a new one:", err)
+			}
+		}
+
+		logger.Chain(chain, config.CheckpointInterval)
+	}
+
+	return logger, nil
+}
+
+// Helper function to fingerprint the key a client authenticated with.
+func fingerprint(key ssh.PublicKey) string {
+	if key == nil {
+		return ""
+	}
+
+	return gossh.FingerprintSHA256(key)
+}
+
+// SessionAudit emits the audit events for a session, counting the bytes it sends and receives.
+type SessionAudit struct {
+	auditor *audit.Logger
+	event   audit.Event
+	start   time.Time
+
+	in  int64
+	out int64
+
+	mu     sync.Mutex
+	code   *int
+	reason string
+}
+
+// NewSessionAudit emits the start of the session. The event describes who started the session
+// and where it is running.
+func NewSessionAudit(auditor *audit.Logger, event audit.Event) *SessionAudit {
+	a := &SessionAudit{
+		auditor: auditor,
+		event:   event,
+		start:   time.Now(),
+	}
+
+	start := a.event
+	start.Type = audit.TypeSessionStart
+	a.auditor.Emit(start)
+
+	return a
+}
+
+// Command emits the command run for the session, it is also included in the end of the session.
+func (a *SessionAudit) Command(command, subsystem string) {
+	a.mu.Lock()
+	a.event.Command = command
+	a.event.Subsystem = subsystem
+	e := a.event
+	a.mu.Unlock()
+
+	e.Type = audit.TypeCommand
+	a.auditor.Emit(e)
+}
+
+// Event returns who started the session, where it is running and what it is running.
+func (a *SessionAudit) Event() audit.Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.event
+}
+
+// Reader counts the bytes sent by the client.
+func (a *SessionAudit) Reader(r io.Reader) io.Reader {
+	return &auditReader{r, &a.in}
+}
+
+// Writer counts the bytes sent to the client.
+func (a *SessionAudit) Writer(w io.Writer) io.Writer {
+	return &auditWriter{w, &a.out}
+}
+
+// Bytes returns the bytes sent by the client and to the client so far.
+func (a *SessionAudit) Bytes() (int64, int64) {
+	return atomic.LoadInt64(&a.in), atomic.LoadInt64(&a.out)
+}
+
+// Exit records the exit status sent to the client.
+func (a *SessionAudit) Exit(code int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.code = audit.Int(code)
+}
+
+// Fail records that the gateway failed to run the session.
+func (a *SessionAudit) Fail(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.code = audit.Int(exitCodeGateway)
+	a.reason = err.Error()
+}
+
+// Closed records why the gateway closed the session.
+func (a *SessionAudit) Closed(reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.reason = reason
+}
+
+// End emits the end of the session, with how long it ran, what it sent and how it exited.
+func (a *SessionAudit) End() audit.Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := a.event
+	e.Type = audit.TypeSessionEnd
+	e.Duration = time.Since(a.start).Seconds()
+	e.BytesIn = atomic.LoadInt64(&a.in)
+	e.BytesOut = atomic.LoadInt64(&a.out)
+	e.ExitCode = a.code
+	e.Reason = a.reason
+	a.auditor.Emit(e)
+
+	return e
+}
+
+type auditReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+type auditWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
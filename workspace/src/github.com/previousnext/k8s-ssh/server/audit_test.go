@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/previousnext/k8s-ssh/audit"
+)
+
+func TestSessionAudit(t *testing.T) {
+	var buf bytes.Buffer
+
+	audited := NewSessionAudit(audit.New(nil, audit.NewWriterSink(&buf)), audit.Event{
+		Session:   "abc123",
+		User:      "nick",
+		Namespace: "dev",
+	})
+
+	audited.Command("ls -la", "")
+
+	ioutil.ReadAll(audited.Reader(strings.NewReader("input")))
+	audited.Writer(ioutil.Discard).Write([]byte("some output"))
+
+	audited.Exit(exitCodeTimeout)
+	audited.Closed("idle timeout")
+	audited.End()
+
+	var events []audit.Event
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e audit.Event
+		assert.Nil(t, json.Unmarshal([]byte(line), &e))
+		events = append(events, e)
+	}
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, audit.TypeSessionStart, events[0].Type)
+	assert.Equal(t, audit.TypeCommand, events[1].Type)
+	assert.Equal(t, "ls -la", events[1].Command)
+
+	end := events[2]
+	assert.Equal(t, audit.TypeSessionEnd, end.Type)
+	assert.Equal(t, "abc123", end.Session)
+	assert.Equal(t, "dev", end.Namespace)
+	assert.Equal(t, int64(5), end.BytesIn)
+	assert.Equal(t, int64(11), end.BytesOut)
+	assert.Equal(t, exitCodeTimeout, *end.ExitCode)
+	assert.Equal(t, "idle timeout", end.Reason)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gliderlabs/ssh"
+	promlog "github.com/prometheus/common/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/previousnext/k8s-ssh/client"
+	"github.com/previousnext/k8s-ssh/crd"
+)
+
+// Reasons authentication was accepted or rejected, for the audit log and metrics.
+const (
+	authReasonAuthorized      = "authorized"
+	authReasonKeyNotAllowed   = "key_not_allowed"
+	authReasonUnknownUser     = "unknown_user"
+	authReasonInvalidUsername = "invalid_username"
+	authReasonSessionNotFound = "session_not_found"
+	authReasonError           = "error"
+)
+
+// Name of the index of users by their name, across all namespaces.
+const authorizerNameIndex = "name"
+
+// Authorizer checks public keys against the SshUser objects in each namespace, which are
+// kept in a cache that is updated by watching the API server.
+type Authorizer struct {
+	users      cache.Indexer
+	controller cache.Controller
+}
+
+// NewAuthorizer returns an authorizer backed by the SshUser CRD. The cache is filled once Run is called.
+func NewAuthorizer(crdcs *rest.RESTClient, scheme *runtime.Scheme) *Authorizer {
+	users, controller := cache.NewIndexerInformer(
+		client.Client(crdcs, scheme, meta_v1.NamespaceAll).NewListWatch(),
+		&crd.SshUser{},
+		0,
+		cache.ResourceEventHandlerFuncs{},
+		cache.Indexers{
+			authorizerNameIndex: userNameIndexFunc,
+		},
+	)
+
+	return &Authorizer{
+		users:      users,
+		controller: controller,
+	}
+}
+
+// Run keeps the cache of users up to date until the channel is closed.
+func (a *Authorizer) Run(stop <-chan struct{}) {
+	a.controller.Run(stop)
+}
+
+// HasSynced returns true once the cache holds all of the users.
+func (a *Authorizer) HasSynced() bool {
+	return a.controller.HasSynced()
+}
+
+// Authorized returns true if the key belongs to the user in the namespace.
+func (a *Authorizer) Authorized(namespace, user string, key ssh.PublicKey) (bool, error) {
+	sshUser, err := a.get(namespace, user)
+	if err != nil {
+		return false, err
+	}
+
+	return hasAuthorizedKey(sshUser, key)
+}
+
+// User returns the user in the namespace, or an error if the key does not belong to them.
+func (a *Authorizer) User(namespace, user string, key ssh.PublicKey) (*crd.SshUser, error) {
+	sshUser, err := a.get(namespace, user)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := hasAuthorizedKey(sshUser, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowed {
+		return nil, fmt.Errorf("key is not authorized for user %s in namespace %s", user, namespace)
+	}
+
+	return sshUser, nil
+}
+
+// Namespaces returns all of the namespaces the user is allowed to connect to with the key.
+func (a *Authorizer) Namespaces(user string, key ssh.PublicKey) ([]string, error) {
+	var namespaces []string
+
+	list, err := a.users.ByIndex(authorizerNameIndex, user)
+	if err != nil {
+		return namespaces, err
+	}
+
+	for _, obj := range list {
+		sshUser := obj.(*crd.SshUser)
+
+		allowed, err := hasAuthorizedKey(sshUser, key)
+		if err != nil {
+			return namespaces, err
+		}
+
+		if allowed {
+			namespaces = append(namespaces, sshUser.Namespace)
+		}
+	}
+
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// Helper function to load a user from the cache, the user must not be modified.
+func (a *Authorizer) get(namespace, user string) (*crd.SshUser, error) {
+	obj, exists, err := a.users.GetByKey(namespace + "/" + user)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Group: crd.Group, Resource: crd.Plural}, user)
+	}
+
+	return obj.(*crd.SshUser), nil
+}
+
+// Helper function to index users by their name, so a user can be found in every namespace.
+func userNameIndexFunc(obj interface{}) ([]string, error) {
+	sshUser, ok := obj.(*crd.SshUser)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object in the user cache: %T", obj)
+	}
+
+	return []string{sshUser.Name}, nil
+}
+
+// Helper function to turn the result of checking a key into the reason it was accepted or rejected.
+func authResult(allowed bool, err error) (bool, string) {
+	if apierrors.IsNotFound(err) {
+		return false, authReasonUnknownUser
+	}
+
+	if err != nil {
+		promlog.Info("Failed to load the user objects:", err)
+		return false, authReasonError
+	}
+
+	if !allowed {
+		return false, authReasonKeyNotAllowed
+	}
+
+	return true, authReasonAuthorized
+}
+
+// Helper function to check if a key is one of the user's authorized keys.
+func hasAuthorizedKey(sshUser *crd.SshUser, key ssh.PublicKey) (bool, error) {
+	for _, authorizedKey := range sshUser.Spec.AuthorizedKeys {
+		allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			return false, err
+		}
+
+		if ssh.KeysEqual(key, allowed) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotation used by kubectl to pick a container when one is not provided.
+const annotationDefaultContainer = "kubectl.kubernetes.io/default-container"
+
+// ContainerResolver picks a container when the container segment of a username is left empty.
+type ContainerResolver struct {
+	clientset kubernetes.Interface
+	sidecars  []string
+}
+
+// NewContainerResolver returns a resolver which never picks the given sidecar containers by default.
+func NewContainerResolver(clientset kubernetes.Interface, sidecars []string) *ContainerResolver {
+	return &ContainerResolver{
+		clientset: clientset,
+		sidecars:  sidecars,
+	}
+}
+
+// Resolve returns the container to connect to. If the pod has more than one candidate
+// the user is asked to pick one on TTY sessions, otherwise the candidates are returned
+// as part of the error.
+func (r *ContainerResolver) Resolve(sess ssh.Session, namespace, name string) (string, error) {
+	pod, err := r.clientset.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	var containers []string
+
+	for _, container := range pod.Spec.Containers {
+		containers = append(containers, container.Name)
+	}
+
+	container, candidates := defaultContainer(pod.Annotations[annotationDefaultContainer], containers, r.sidecars)
+	if container != "" {
+		return container, nil
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("pod does not have any containers: %s", name)
+	}
+
+	if _, _, isPty := sess.Pty(); isPty {
+		return promptChoice(sess, fmt.Sprintf("Pod %s has multiple containers:", name), candidates)
+	}
+
+	return "", fmt.Errorf("pod %s has multiple containers, choose one of: %s", name, strings.Join(candidates, ", "))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Environment variables set by the server so processes know who is connected.
+const (
+	envUser      = "K8S_SSH_USER"
+	envSessionID = "K8S_SSH_SESSION_ID"
+)
+
+// Names which are safe to pass to the "env" command.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Helper function to filter the client's environment down to the variables which match the
+// allowed patterns eg. "LANG" or "LC_*".
+func filterEnv(environ, allowed []string) []string {
+	var env []string
+
+	for _, kv := range environ {
+		sl := strings.SplitN(kv, "=", 2)
+		if len(sl) != 2 || !envName.MatchString(sl[0]) {
+			continue
+		}
+
+		for _, pattern := range allowed {
+			if ok, _ := path.Match(strings.TrimSpace(pattern), sl[0]); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+
+	return env
+}
+
+// EnvChecker remembers which containers have an "env" command, so commands in containers without
+// one eg. distroless images can be run without the environment variables.
+type EnvChecker struct {
+	mu         sync.Mutex
+	containers map[string]bool
+}
+
+// NewEnvChecker returns a checker which has not seen any containers.
+func NewEnvChecker() *EnvChecker {
+	return &EnvChecker{
+		containers: make(map[string]bool),
+	}
+}
+
+// Supported returns true if the container can run the "env" command. Containers without it are
+// checked again next time, in case the check failed for another reason.
+func (c *EnvChecker) Supported(runner *PodRunner) bool {
+	container := runner.Container()
+
+	c.mu.Lock()
+	ok := c.containers[container]
+	c.mu.Unlock()
+
+	if ok {
+		return true
+	}
+
+	if runner.Run([]string{"env", "true"}, nil, ioutil.Discard, ioutil.Discard) != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	c.containers[container] = true
+	c.mu.Unlock()
+
+	return true
+}
+
+// Helper function to run a command with additional environment variables. The exec API
+// does not support setting environment variables, so the "env" command is used instead.
+func envCommand(env, cmd []string) []string {
+	if len(env) == 0 {
+		return cmd
+	}
+
+	return append(append([]string{"env"}, env...), cmd...)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterEnv(t *testing.T) {
+	environ := []string{
+		"LANG=en_AU.UTF-8",
+		"LC_ALL=en_AU.UTF-8",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"BAD-NAME=foo",
+		"TERM=xterm-256color",
+	}
+
+	assert.Equal(t, []string{"LANG=en_AU.UTF-8", "LC_ALL=en_AU.UTF-8", "TERM=xterm-256color"}, filterEnv(environ, []string{"TERM", "LANG", "LC_*", "COLORTERM"}))
+	assert.Empty(t, filterEnv(environ, []string{}))
+}
+
+func TestEnvCommand(t *testing.T) {
+	assert.Equal(t, []string{"/bin/bash"}, envCommand(nil, []string{"/bin/bash"}))
+	assert.Equal(t, []string{"env", "TERM=xterm", "/bin/bash"}, envCommand([]string{"TERM=xterm"}, []string{"/bin/bash"}))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	promlog "github.com/prometheus/common/log"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/previousnext/k8s-ssh/audit"
+)
+
+// Reasons for the events recorded against pods, shown by "kubectl describe pod".
+const (
+	eventReasonSessionStarted = "SSHSessionStarted"
+	eventReasonSessionEnded   = "SSHSessionEnded"
+	eventReasonSessionFailed  = "SSHSessionFailed"
+)
+
+// Name the gateway records events as.
+const eventComponent = "k8s-ssh"
+
+// Longest command shown in an event.
+const eventMaxCommand = 256
+
+// PodEvents records Kubernetes Events against the pods users connect to. Sessions are rate
+// limited, so automation which connects often does not flood the API server.
+type PodEvents struct {
+	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+	limiter   flowcontrol.RateLimiter
+
+	mu       sync.Mutex
+	sessions map[string]bool
+}
+
+// NewPodEvents returns a recorder which allows events for this many sessions per second, with
+// bursts of up to the limit.
+func NewPodEvents(clientset kubernetes.Interface, qps float32, burst int) *PodEvents {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(""),
+	})
+
+	return &PodEvents{
+		clientset: clientset,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent}),
+		limiter:   flowcontrol.NewTokenBucketRateLimiter(qps, burst),
+		sessions:  make(map[string]bool),
+	}
+}
+
+// Started records the start of a session. Sessions which are over the rate limit are skipped,
+// along with their end.
+func (p *PodEvents) Started(e audit.Event) {
+	if p == nil || !p.limiter.TryAccept() {
+		return
+	}
+
+	p.mu.Lock()
+	p.sessions[e.Session] = true
+	p.mu.Unlock()
+
+	p.record(e, v1.EventTypeNormal, eventReasonSessionStarted, fmt.Sprintf("SshUser %s connected from %s to container %s%s", e.User, e.RemoteAddr, e.Container, eventCommand(e)))
+}
+
+// Ended records the end of a session, as a warning if it failed.
+func (p *PodEvents) Ended(e audit.Event) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	started := p.sessions[e.Session]
+	delete(p.sessions, e.Session)
+	p.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	duration := roundDuration(time.Duration(e.Duration*float64(time.Second)), time.Second)
+
+	if e.ExitCode != nil && *e.ExitCode == exitCodeGateway {
+		p.record(e, v1.EventTypeWarning, eventReasonSessionFailed, fmt.Sprintf("Session of SshUser %s from %s%s failed after %s: %s", e.User, e.RemoteAddr, eventCommand(e), duration, e.Reason))
+		return
+	}
+
+	var status string
+
+	if e.ExitCode != nil {
+		status = fmt.Sprintf(", exited with status %d", *e.ExitCode)
+	}
+
+	if e.Reason != "" {
+		status += fmt.Sprintf(", closed due to %s", e.Reason)
+	}
+
+	p.record(e, v1.EventTypeNormal, eventReasonSessionEnded, fmt.Sprintf("Session of SshUser %s from %s%s ended after %s%s", e.User, e.RemoteAddr, eventCommand(e), duration, status))
+}
+
+// Helper function to record an event against the pod. The pod is looked up in the background,
+// events need its UID to be shown with it.
+func (p *PodEvents) record(e audit.Event, eventtype, reason, message string) {
+	go func() {
+		pod, err := p.clientset.CoreV1().Pods(e.Namespace).Get(e.Pod, meta_v1.GetOptions{})
+		if err != nil {
+			promlog.Info("Failed to get pod for event:", err)
+			return
+		}
+
+		p.recorder.Event(pod, eventtype, reason, message)
+	}()
+}
+
+// Helper function to describe the command run by a session eg. " running 'ls -la'".
+func eventCommand(e audit.Event) string {
+	command := e.Command
+	if e.Subsystem != "" {
+		command = e.Subsystem
+	}
+
+	if command == "" {
+		return ""
+	}
+
+	command = strings.Replace(command, "\n", " ", -1)
+	if len(command) > eventMaxCommand {
+		command = command[:eventMaxCommand] + "..."
+	}
+
+	return fmt.Sprintf(" running '%s'", command)
+}
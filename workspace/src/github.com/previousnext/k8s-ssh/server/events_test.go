@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/previousnext/k8s-ssh/audit"
+)
+
+func TestEventCommand(t *testing.T) {
+	assert.Equal(t, "", eventCommand(audit.Event{}))
+	assert.Equal(t, " running 'ls -la'", eventCommand(audit.Event{Command: "ls -la"}))
+	assert.Equal(t, " running 'sftp'", eventCommand(audit.Event{Subsystem: "sftp"}))
+	assert.Equal(t, " running 'cd /app && php artisan migrate'", eventCommand(audit.Event{Command: "cd /app &&\nphp artisan migrate"}))
+
+	long := eventCommand(audit.Event{Command: strings.Repeat("a", 300)})
+	assert.Equal(t, " running '"+strings.Repeat("a", eventMaxCommand)+"...'", long)
+}
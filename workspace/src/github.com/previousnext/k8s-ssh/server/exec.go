@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/gliderlabs/ssh"
+	"k8s.io/api/core/v1"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Executor starts a session's command in its container.
+type Executor func(ctx context.Context, cmd *v1.PodExecOptions) (Streamer, error)
+
+// Streamer streams the input and output of a command until it exits.
+type Streamer interface {
+	Stream(options remotecommand.StreamOptions) error
+}
+
+// Helper function to get an executor which runs commands with the Kubernetes API, they are torn
+// down when the context is cancelled.
+func podExecutor(config *rest.Config, url func(*v1.PodExecOptions) *url.URL) Executor {
+	return func(ctx context.Context, cmd *v1.PodExecOptions) (Streamer, error) {
+		return newExecutor(ctx, config, url(cmd))
+	}
+}
+
+// Helper function to build the default options sent to the Kubernetes API for a session.
+// Stdin is always attached, the remote side sees EOF when the client closes its input.
+// A TTY is only allocated if the client asked for one eg. "ssh -t host top".
+func execOptions(sess ssh.Session, container string) (*v1.PodExecOptions, remotecommand.StreamOptions) {
+	_, _, isPty := sess.Pty()
+
+	cmd := &v1.PodExecOptions{
+		Container: container,
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    !isPty,
+		TTY:       isPty,
+		Command:   sess.Command(),
+	}
+
+	opts := remotecommand.StreamOptions{
+		// Negotiating a protocol version is required for the API server to return exit codes.
+		SupportedProtocols: remotecommandconsts.SupportedStreamingProtocols,
+		Stdin:              sess,
+		Stdout:             sess,
+		Stderr:             sess.Stderr(),
+		Tty:                isPty,
+	}
+
+	return cmd, opts
+}
+
+// Helper function to build the command for a session and the options to stream it with, along
+// with the type of session. Commands are run by the shell (as OpenSSH does) if commandShell is
+// set, so that shell syntax works eg. "cd /app && php artisan migrate".
+func sessionCommand(sess ssh.Session, container, shell string, commandShell bool) (*v1.PodExecOptions, remotecommand.StreamOptions, string) {
+	cmd, opts := execOptions(sess, container)
+
+	// The command is checked before it is wrapped by the shell, scp quotes its paths for the shell.
+	scp := isScp(cmd.Command)
+
+	kind := sessionTypeExec
+
+	if commandShell && !isShell(cmd.Command) && !isRsync(cmd.Command) {
+		cmd.Command = shellCommand(shell, sess.RawCommand())
+	}
+
+	// Provide a fully featured shell from the remote environment.
+	if isShell(cmd.Command) && sess.Subsystem() == "" {
+		kind = sessionTypeShell
+		cmd.Command = []string{shell}
+	}
+
+	// Binary safe streams for syncing.
+	if isRsync(cmd.Command) {
+		kind = sessionTypeRsync
+		binaryMode(cmd, &opts)
+	}
+
+	// "scp -t" and "scp -f" stream files over stdin and stdout.
+	if scp {
+		kind = sessionTypeScp
+		binaryMode(cmd, &opts)
+	}
+
+	return cmd, opts, kind
+}
+
+// Helper function to stream a command without a TTY, so file transfers (rsync, scp, sftp)
+// are binary safe and stderr is kept separate from the data on stdout.
+func binaryMode(cmd *v1.PodExecOptions, opts *remotecommand.StreamOptions) {
+	opts.Tty = false
+	cmd.TTY = false
+	cmd.Stderr = true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// A session running a command, with or without a terminal.
+type execSession struct {
+	ssh.Session
+
+	command []string
+	pty     bool
+	stderr  bytes.Buffer
+}
+
+func (s *execSession) Command() []string {
+	return s.command
+}
+
+func (s *execSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return ssh.Pty{}, nil, s.pty
+}
+
+func (s *execSession) Stderr() io.ReadWriter {
+	return &s.stderr
+}
+
+func TestExecOptions(t *testing.T) {
+	sess := &execSession{command: []string{"top"}, pty: true}
+
+	cmd, opts := execOptions(sess, "app")
+	assert.Equal(t, "app", cmd.Container)
+	assert.Equal(t, []string{"top"}, cmd.Command)
+	assert.True(t, cmd.Stdin)
+	assert.True(t, cmd.TTY)
+	assert.True(t, opts.Tty)
+
+	// Stderr is merged into the terminal's output.
+	assert.False(t, cmd.Stderr)
+}
+
+func TestBinaryMode(t *testing.T) {
+	// eg. "ssh -t host scp -t /app", a terminal would mangle the transfer.
+	sess := &execSession{command: []string{"scp", "-t", "--", "/app"}, pty: true}
+
+	cmd, opts := execOptions(sess, "app")
+	assert.True(t, isScp(cmd.Command))
+
+	binaryMode(cmd, &opts)
+	assert.False(t, cmd.TTY)
+	assert.False(t, opts.Tty)
+	assert.True(t, cmd.Stdin)
+	assert.True(t, cmd.Stderr)
+	assert.Equal(t, &sess.stderr, opts.Stderr)
+}
+
+// In-memory container which runs the scp sink (-t) and source (-f), standing in for the Kubernetes API.
+type scpContainer struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+// Executor runs commands against the in-memory files.
+func (c *scpContainer) Executor(ctx context.Context, cmd *v1.PodExecOptions) (Streamer, error) {
+	return &scpExec{c, cmd}, nil
+}
+
+type scpExec struct {
+	container *scpContainer
+	cmd       *v1.PodExecOptions
+}
+
+// Stream runs scp, a TTY would corrupt the transfer.
+func (e *scpExec) Stream(opts remotecommand.StreamOptions) error {
+	args := e.cmd.Command
+
+	// Commands are run by the shell eg. "/bin/bash -c 'scp -t /app'".
+	if len(args) == 3 && args[1] == "-c" {
+		args = strings.Fields(args[2])
+	}
+
+	if !isScp(args) {
+		return fmt.Errorf("command not found: %s", args[0])
+	}
+
+	if opts.Tty || e.cmd.TTY || opts.Stdin == nil {
+		return fmt.Errorf("scp must be streamed without a TTY and with stdin attached")
+	}
+
+	r := bufio.NewReader(opts.Stdin)
+	target := args[len(args)-1]
+
+	for _, arg := range args {
+		if arg == "-f" {
+			return e.container.source(r, opts.Stdout, target)
+		}
+	}
+
+	return e.container.sink(r, opts.Stdout, target)
+}
+
+// Helper function to receive files from the client.
+func (c *scpContainer) sink(r *bufio.Reader, w io.Writer, target string) error {
+	w.Write([]byte{0})
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// eg. "C0644 12 foo.txt"
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		if line[0] != 'C' || len(fields) != 3 {
+			fmt.Fprintf(w, "\x01scp: unsupported message: %q\n", line)
+			return fmt.Errorf("unsupported message: %q", line)
+		}
+
+		size, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte{0})
+
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		name := target
+		if c.dirs[target] {
+			name = path.Join(target, fields[2])
+		}
+
+		c.mu.Lock()
+		c.files[name] = data[:size]
+		c.mu.Unlock()
+
+		w.Write([]byte{0})
+	}
+}
+
+// Helper function to send a file to the client.
+func (c *scpContainer) source(r *bufio.Reader, w io.Writer, target string) error {
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return fmt.Errorf("client not ready")
+	}
+
+	c.mu.Lock()
+	data, ok := c.files[target]
+	c.mu.Unlock()
+
+	if !ok {
+		fmt.Fprintf(w, "\x01scp: %s: No such file or directory\n", target)
+		return fmt.Errorf("no such file: %s", target)
+	}
+
+	fmt.Fprintf(w, "C0644 %d %s\n", len(data), path.Base(target))
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return fmt.Errorf("client rejected file")
+	}
+
+	w.Write(append(data, 0))
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return fmt.Errorf("client failed to receive file")
+	}
+
+	return nil
+}
+
+// Helper function to start scp on the server, returning its input and output.
+func startScp(t *testing.T, client *gossh.Client, command string) (*gossh.Session, io.WriteCloser, *bufio.Reader) {
+	sess, err := client.NewSession()
+	assert.Nil(t, err)
+
+	stdin, err := sess.StdinPipe()
+	assert.Nil(t, err)
+
+	stdout, err := sess.StdoutPipe()
+	assert.Nil(t, err)
+
+	assert.Nil(t, sess.Start(command))
+
+	return sess, stdin, bufio.NewReader(stdout)
+}
+
+// Helper function to read an acknowledgement from scp, or the error it sent instead.
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if b != 0 {
+		line, _ := r.ReadString('\n')
+		return fmt.Errorf("scp: %s", strings.TrimSpace(line))
+	}
+
+	return nil
+}
+
+func TestScp(t *testing.T) {
+	container := &scpContainer{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/app": true},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := &ssh.Server{
+		Handler: func(sess ssh.Session) {
+			cmd, opts, kind := sessionCommand(sess, "app", "/bin/bash", true)
+			assert.Equal(t, sessionTypeScp, kind)
+
+			exec, err := container.Executor(sess.Context(), cmd)
+			if err != nil {
+				exitWithError(sess, err)
+				return
+			}
+
+			if err := exec.Stream(opts); err != nil {
+				exitWithError(sess, err)
+				return
+			}
+
+			sess.Exit(0)
+		},
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	client, err := gossh.Dial("tcp", listener.Addr().String(), &gossh.ClientConfig{
+		User:            "namespace~pod~app~user",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// Newlines, carriage returns and NULs would all be mangled by a TTY.
+	data := []byte("line one\nline two\r\n\x00\xff\x03 binary")
+
+	// Upload, as "scp upload.bin host:/app" does.
+	sess, stdin, stdout := startScp(t, client, "scp -t -- /app")
+	assert.Nil(t, scpAck(stdout))
+	fmt.Fprintf(stdin, "C0644 %d upload.bin\n", len(data))
+	assert.Nil(t, scpAck(stdout))
+	stdin.Write(append(data, 0))
+	assert.Nil(t, scpAck(stdout))
+	stdin.Close()
+	assert.Nil(t, sess.Wait())
+
+	container.mu.Lock()
+	assert.Equal(t, data, container.files["/app/upload.bin"])
+	container.mu.Unlock()
+
+	// Download, as "scp host:/app/upload.bin ." does.
+	sess, stdin, stdout = startScp(t, client, "scp -f -- /app/upload.bin")
+	stdin.Write([]byte{0})
+	header, err := stdout.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("C0644 %d upload.bin\n", len(data)), header)
+	stdin.Write([]byte{0})
+	downloaded := make([]byte, len(data))
+	_, err = io.ReadFull(stdout, downloaded)
+	assert.Nil(t, err)
+	assert.Nil(t, scpAck(stdout))
+	stdin.Write([]byte{0})
+	stdin.Close()
+	assert.Nil(t, sess.Wait())
+	assert.Equal(t, data, downloaded)
+
+	// Missing files are reported to the client.
+	sess, stdin, stdout = startScp(t, client, "scp -f -- /app/missing.bin")
+	stdin.Write([]byte{0})
+	assert.NotNil(t, scpAck(stdout))
+	stdin.Close()
+	assert.NotNil(t, sess.Wait())
+}
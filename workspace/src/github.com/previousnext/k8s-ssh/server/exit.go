@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gliderlabs/ssh"
+	"k8s.io/client-go/util/exec"
+)
+
+// Exit code returned when the gateway could not run the command eg. the pod does not
+// exist, the API server is unreachable or the request was denied. This mirrors the code
+// OpenSSH uses for its own errors so scripts can tell it apart from the command failing.
+const exitCodeGateway = 255
+
+// Helper function to map the error returned from a remote command stream onto the exit
+// status of the remote process. Errors which did not come from the remote process are
+// reported as not being remote.
+//
+// The API server only reports the exit code, so a process terminated by a signal is
+// returned as the code the container runtime gives it eg. 137 for SIGKILL, and not as
+// an SSH "exit-signal" which could not be told apart from a command exiting with 130.
+func exitStatus(err error) (code int, remote bool) {
+	if err == nil {
+		return 0, true
+	}
+
+	exitErr, ok := err.(exec.ExitError)
+	if !ok || !exitErr.Exited() {
+		return exitCodeGateway, false
+	}
+
+	return exitErr.ExitStatus(), true
+}
+
+// Helper function to send the exit status of the remote process to the SSH client.
+func exitWithStatus(sess ssh.Session, code int) error {
+	return sess.Exit(code)
+}
+
+// Helper function to report a failure of the gateway itself to the SSH client.
+func exitWithError(sess ssh.Session, err error) error {
+	// Return the error output to the end user so they can see why the request failed.
+	io.WriteString(sess.Stderr(), err.Error()+"\n")
+
+	return sess.Exit(exitCodeGateway)
+}
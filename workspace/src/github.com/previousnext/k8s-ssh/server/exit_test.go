@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/exec"
+)
+
+func TestExitStatus(t *testing.T) {
+	code, remote := exitStatus(nil)
+	assert.Equal(t, 0, code)
+	assert.True(t, remote)
+
+	code, remote = exitStatus(exec.CodeExitError{Err: fmt.Errorf("failed"), Code: 3})
+	assert.Equal(t, 3, code)
+	assert.True(t, remote)
+
+	// Codes which look like a signal are still sent as an exit status eg. "exit 130".
+	code, remote = exitStatus(exec.CodeExitError{Err: fmt.Errorf("interrupted"), Code: 130})
+	assert.Equal(t, 130, code)
+	assert.True(t, remote)
+
+	code, remote = exitStatus(fmt.Errorf("pods \"foo\" not found"))
+	assert.Equal(t, exitCodeGateway, code)
+	assert.False(t, remote)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+
+	"github.com/previousnext/k8s-ssh/audit"
+	"github.com/previousnext/log"
+)
+
+// Forwarder tunnels connections to pods over the Kubernetes port-forward API, so the
+// gateway does not need access to the pod network.
+type Forwarder struct {
+	config     *rest.Config
+	clientset  kubernetes.Interface
+	pods       *PodResolver
+	authorizer *Authorizer
+	ports      PortPolicy
+	auditor    *audit.Logger
+}
+
+// NewForwarder returns a forwarder which allows each group to forward to the ports in the policy.
+func NewForwarder(config *rest.Config, clientset kubernetes.Interface, pods *PodResolver, authorizer *Authorizer, ports PortPolicy, auditor *audit.Logger) *Forwarder {
+	return &Forwarder{
+		config:     config,
+		clientset:  clientset,
+		pods:       pods,
+		authorizer: authorizer,
+		ports:      ports,
+		auditor:    auditor,
+	}
+}
+
+// Destination is the pod and port a tunnel is connected to.
+type Destination struct {
+	Namespace string
+	Pod       string
+	Port      int
+}
+
+// Namespace returns the namespace to forward to. A namespace in the destination must be one
+// the user is allowed in, otherwise the namespace from the username is used.
+func (f *Forwarder) Namespace(identity, requested, user string, key ssh.PublicKey) (string, error) {
+	if requested == "" && identity != "" {
+		return identity, nil
+	}
+
+	namespaces, err := f.authorizer.Namespaces(user, key)
+	if err != nil {
+		return "", err
+	}
+
+	if requested == "" {
+		if len(namespaces) == 1 {
+			return namespaces[0], nil
+		}
+
+		return "", fmt.Errorf("destination requires a namespace eg. service.namespace")
+	}
+
+	if !contains(namespaces, requested) {
+		return "", fmt.Errorf("not allowed to forward to namespace: %s", requested)
+	}
+
+	return requested, nil
+}
+
+// Authorize checks the user is allowed to forward to the port within the namespace.
+func (f *Forwarder) Authorize(namespace, user string, key ssh.PublicKey, port int) error {
+	sshUser, err := f.authorizer.User(namespace, user, key)
+	if err != nil {
+		return err
+	}
+
+	if !f.ports.Allowed(sshUser.Spec.Groups, port) {
+		return fmt.Errorf("forwarding to port %d is not allowed", port)
+	}
+
+	return nil
+}
+
+// Resolve returns the pod and port for a host within the namespace. The host can be the
+// name of a service, which is resolved to one of its Ready pods, or the name of a pod.
+func (f *Forwarder) Resolve(namespace, host string, port int) (Destination, error) {
+	service, err := f.clientset.CoreV1().Services(namespace).Get(host, meta_v1.GetOptions{})
+	if err == nil {
+		return f.resolveService(service, port)
+	}
+
+	if !apierrors.IsNotFound(err) {
+		return Destination{}, err
+	}
+
+	pod, err := f.clientset.CoreV1().Pods(namespace).Get(host, meta_v1.GetOptions{})
+	if err != nil {
+		return Destination{}, err
+	}
+
+	if !isPodReady(*pod) {
+		return Destination{}, fmt.Errorf("pod is not ready: %s", host)
+	}
+
+	return Destination{
+		Namespace: namespace,
+		Pod:       pod.Name,
+		Port:      port,
+	}, nil
+}
+
+// Helper function to resolve a service port to a Ready pod and the port it sends traffic to.
+func (f *Forwarder) resolveService(service *v1.Service, port int) (Destination, error) {
+	if len(service.Spec.Selector) == 0 {
+		return Destination{}, fmt.Errorf("service does not have a selector: %s", service.Name)
+	}
+
+	var servicePort *v1.ServicePort
+
+	for i, p := range service.Spec.Ports {
+		if int(p.Port) == port && p.Protocol != v1.ProtocolUDP {
+			servicePort = &service.Spec.Ports[i]
+		}
+	}
+
+	if servicePort == nil {
+		return Destination{}, fmt.Errorf("service %s does not expose port %d", service.Name, port)
+	}
+
+	name, err := f.pods.resolveSelector(service.Namespace, "svc/"+service.Name, labels.SelectorFromSet(service.Spec.Selector))
+	if err != nil {
+		return Destination{}, err
+	}
+
+	pod, err := f.clientset.CoreV1().Pods(service.Namespace).Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		return Destination{}, err
+	}
+
+	target, err := targetPort(pod, *servicePort)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	return Destination{
+		Namespace: service.Namespace,
+		Pod:       pod.Name,
+		Port:      target,
+	}, nil
+}
+
+// Helper function to find the port on a pod which a service port sends traffic to.
+func targetPort(pod *v1.Pod, servicePort v1.ServicePort) (int, error) {
+	switch {
+	case servicePort.TargetPort.Type == intstr.String && servicePort.TargetPort.StrVal != "":
+		for _, container := range pod.Spec.Containers {
+			for _, p := range container.Ports {
+				if p.Name == servicePort.TargetPort.StrVal {
+					return int(p.ContainerPort), nil
+				}
+			}
+		}
+
+		return 0, fmt.Errorf("pod %s does not have a port named %s", pod.Name, servicePort.TargetPort.StrVal)
+
+	case servicePort.TargetPort.IntVal != 0:
+		return int(servicePort.TargetPort.IntVal), nil
+	}
+
+	return int(servicePort.Port), nil
+}
+
+// Dial opens a connection to the destination, which is closed when the context is cancelled.
+func (f *Forwarder) Dial(ctx context.Context, dest Destination) (*forwardConn, error) {
+	url := f.clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(dest.Namespace).Name(dest.Pod).SubResource("portforward").URL()
+
+	dialer, err := newExecutor(ctx, f.config, url)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each connection gets its own stream pair, so the request ID never has to change.
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.Itoa(dest.Port))
+	headers.Set(v1.PortForwardRequestIDHeader, "0")
+
+	errorStream, err := conn.CreateStream(headers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Nothing is written to the error stream.
+	errorStream.Close()
+
+	errors := make(chan error, 1)
+
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errors <- fmt.Errorf("failed to read from the error stream for port %d: %s", dest.Port, err)
+		case len(message) > 0:
+			errors <- fmt.Errorf("failed to forward to port %d: %s", dest.Port, string(message))
+		}
+		close(errors)
+	}()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+
+	dataStream, err := conn.CreateStream(headers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &forwardConn{
+		conn:   conn,
+		data:   dataStream,
+		errors: errors,
+	}, nil
+}
+
+// forwardConn is a connection to a port on a pod.
+type forwardConn struct {
+	conn   httpstream.Connection
+	data   httpstream.Stream
+	errors chan error
+}
+
+// Read reads from the pod, errors such as nothing listening on the port are returned at the end of the stream.
+func (c *forwardConn) Read(p []byte) (int, error) {
+	n, err := c.data.Read(p)
+	if err == io.EOF {
+		if streamErr := <-c.errors; streamErr != nil {
+			return n, streamErr
+		}
+	}
+
+	return n, err
+}
+
+// Write writes to the pod.
+func (c *forwardConn) Write(p []byte) (int, error) {
+	return c.data.Write(p)
+}
+
+// CloseWrite tells the pod nothing more will be sent.
+func (c *forwardConn) CloseWrite() error {
+	return c.data.Close()
+}
+
+// Close closes the connection.
+func (c *forwardConn) Close() error {
+	return c.conn.Close()
+}
+
+// A connection which can tell the other side nothing more will be sent eg. *net.TCPConn.
+type closeWriter interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+// Helper function to copy data between a channel and a connection until both sides are
+// finished, returning the number of bytes sent to and received from the connection.
+func tunnel(ch gossh.Channel, conn closeWriter) (int64, int64, error) {
+	defer conn.Close()
+
+	sent := make(chan int64, 1)
+
+	go func() {
+		n, _ := io.Copy(conn, ch)
+		conn.CloseWrite()
+		sent <- n
+	}()
+
+	received, err := io.Copy(ch, conn)
+
+	// Closing the channel stops the client sending anything else.
+	ch.Close()
+
+	return <-sent, received, err
+}
+
+// forwardData is the payload of a "direct-tcpip" channel, as specified in RFC 4254, section 7.2.
+type forwardData struct {
+	DestinationHost string
+	DestinationPort uint32
+	OriginatorHost  string
+	OriginatorPort  uint32
+}
+
+// DirectTCPIPHandler handles local (ssh -L) and dynamic (ssh -D) port forwarding by tunnelling
+// connections to pods and services in the namespaces the user is allowed in.
+func (f *Forwarder) DirectTCPIPHandler(router Router) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		// Generate a unique ID for this tunnel.
+		// This will be used for logging connections.
+		logger := log.New()
+
+		var d forwardData
+
+		if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+			newChan.Reject(gossh.ConnectionFailed, "failed to parse forward data: "+err.Error())
+			return
+		}
+
+		host, port := d.DestinationHost, int(d.DestinationPort)
+
+		identity, user, err := router.Identity(ctx.User())
+		if err != nil {
+			newChan.Reject(gossh.Prohibited, err.Error())
+			return
+		}
+
+		name, requested, err := splitForwardHost(host)
+		if err != nil {
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			return
+		}
+
+		key, _ := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+
+		namespace, err := f.Namespace(identity, requested, user, key)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Refused tunnel for user %s to %s:%d: %s", user, host, port, err.Error()))
+			newChan.Reject(gossh.Prohibited, err.Error())
+			return
+		}
+
+		err = f.Authorize(namespace, user, key, port)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Refused tunnel for user %s to %s:%d in namespace %s: %s", user, host, port, namespace, err.Error()))
+			newChan.Reject(gossh.Prohibited, err.Error())
+			return
+		}
+
+		dest, err := f.Resolve(namespace, name, port)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to resolve tunnel for user %s to %s:%d in namespace %s: %s", user, host, port, namespace, err.Error()))
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			return
+		}
+
+		// A service can send traffic to a different port on the pod, which must also be allowed.
+		if dest.Port != port {
+			err = f.Authorize(namespace, user, key, dest.Port)
+			if err != nil {
+				logger.Print(fmt.Sprintf("Refused tunnel for user %s to %s:%d in namespace %s (pod %s port %d): %s", user, host, port, namespace, dest.Pod, dest.Port, err.Error()))
+				newChan.Reject(gossh.Prohibited, err.Error())
+				return
+			}
+		}
+
+		remote, err := f.Dial(ctx, dest)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to open tunnel for user %s to pod %s port %d: %s", user, dest.Pod, dest.Port, err.Error()))
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			return
+		}
+
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			remote.Close()
+			return
+		}
+		go gossh.DiscardRequests(reqs)
+
+		logger.Print(fmt.Sprintf("Opened tunnel for user %s from %s to %s:%d in namespace %s (pod %s port %d)", user, ctx.RemoteAddr(), host, port, namespace, dest.Pod, dest.Port))
+
+		f.auditor.Emit(audit.Event{
+			Type:        audit.TypeForwardOpen,
+			Session:     logger.ID(),
+			User:        user,
+			Fingerprint: fingerprint(key),
+			RemoteAddr:  ctx.RemoteAddr().String(),
+			Namespace:   namespace,
+			Pod:         dest.Pod,
+			Forward: &audit.Forward{
+				Kind: audit.ForwardLocal,
+				Host: host,
+				Port: d.DestinationPort,
+			},
+		})
+
+		start := time.Now()
+		untrack := trackSession(namespace, sessionTypeForward)
+
+		sent, received, err := tunnel(ch, remote)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Tunnel for user %s to %s:%d failed: %s", user, host, port, err.Error()))
+		}
+
+		untrack(sent, received)
+
+		logger.Print(fmt.Sprintf("Closed tunnel for user %s to %s:%d after %s (sent %d bytes, received %d bytes)", user, host, port, time.Since(start), sent, received))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/previousnext/k8s-ssh/crd"
+)
+
+func TestForwardServiceTargetPort(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	key, err := gossh.NewPublicKey(public)
+	assert.Nil(t, err)
+
+	users := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		authorizerNameIndex: userNameIndexFunc,
+	})
+	users.Add(&crd.SshUser{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "dev", Name: "alice"},
+		Spec: crd.SshUserSpec{
+			Groups:         []string{"dev"},
+			AuthorizedKeys: []string{string(gossh.MarshalAuthorizedKey(key))},
+		},
+	})
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Namespace: "dev", Name: "web"},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "db"},
+				Ports: []v1.ServicePort{
+					{Port: 80, TargetPort: intstr.FromInt(5432)},
+				},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Namespace: "dev", Name: "db-1", Labels: map[string]string{"app": "db"}},
+			Status: v1.PodStatus{
+				Phase:      v1.PodRunning,
+				Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+			},
+		},
+	)
+
+	ports, err := parsePortPolicy("dev=80")
+	assert.Nil(t, err)
+
+	f := NewForwarder(nil, clientset, NewPodResolver(clientset, "", NewSessionCounter()), &Authorizer{users: users}, ports, nil)
+
+	assert.Nil(t, f.Authorize("dev", "alice", key, 80))
+
+	dest, err := f.Resolve("dev", "web", 80)
+	assert.Nil(t, err)
+	assert.Equal(t, Destination{Namespace: "dev", Pod: "db-1", Port: 5432}, dest)
+
+	// The service port is allowed, but the port on the pod it sends traffic to is not.
+	assert.NotNil(t, f.Authorize("dev", "alice", key, dest.Port))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promlog "github.com/prometheus/common/log"
+)
+
+// Reason the gateway is not ready once it has started shutting down.
+const readinessShutdown = "shutting down"
+
+// Readiness reports whether the gateway should be sent new connections, for the /readyz endpoint.
+type Readiness struct {
+	mu       sync.Mutex
+	checks   []readinessCheck
+	draining bool
+}
+
+type readinessCheck struct {
+	name  string
+	ready func() bool
+}
+
+// NewReadiness returns a readiness which is ready until checks are added.
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// Add a check which must pass before the gateway is ready.
+func (r *Readiness) Add(name string, ready func() bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, readinessCheck{name, ready})
+}
+
+// Pending adds a check which passes once the returned function has been called.
+func (r *Readiness) Pending(name string) func() {
+	var (
+		mu   sync.Mutex
+		done bool
+	)
+
+	r.Add(name, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return done
+	})
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+	}
+}
+
+// Drain marks the gateway as not ready for good, once it has started shutting down.
+func (r *Readiness) Drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+}
+
+// NotReady returns the reasons the gateway is not ready, or nothing if it is.
+func (r *Readiness) NotReady() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var reasons []string
+
+	if r.draining {
+		reasons = append(reasons, readinessShutdown)
+	}
+
+	for _, check := range r.checks {
+		if !check.ready() {
+			reasons = append(reasons, fmt.Sprintf("waiting for %s", check.name))
+		}
+	}
+
+	return reasons
+}
+
+// ServeHTTP responds with 200 if the gateway is ready, or 503 and the reasons it is not.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if reasons := r.NotReady(); len(reasons) > 0 {
+		http.Error(w, strings.Join(reasons, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// Helper function to respond to liveness checks, the gateway is alive for as long as it can serve them.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Helper function to serve the metrics and health checks over HTTP.
+func serveHTTP(addr string, ready *Readiness) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.Handle("/readyz", ready)
+
+	promlog.Info("Serving metrics and health checks on:", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		promlog.Fatalf("Failed to serve metrics and health checks: %s", err)
+	}
+}
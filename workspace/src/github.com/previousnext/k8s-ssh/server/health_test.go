@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	ready := NewReadiness()
+
+	synced := false
+	ready.Add("users", func() bool { return synced })
+	listening := ready.Pending("ssh")
+
+	assert.Equal(t, []string{"waiting for users", "waiting for ssh"}, ready.NotReady())
+
+	synced = true
+	listening()
+	assert.Empty(t, ready.NotReady())
+
+	w := httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	ready.Drain()
+	assert.Equal(t, []string{readinessShutdown}, ready.NotReady())
+
+	w = httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "shutting down\n", w.Body.String())
+}
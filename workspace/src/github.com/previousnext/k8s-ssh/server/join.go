@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gliderlabs/ssh"
+
+	"github.com/previousnext/k8s-ssh/audit"
+	"github.com/previousnext/log"
+)
+
+// Helper function to connect a user to a session which has been shared with them.
+func joinSession(sess ssh.Session, hub *SessionHub, authorizer *Authorizer, auditor *audit.Logger, id, user, mode string) {
+	// Generate a unique ID for this viewer.
+	// This will be used for logging connections.
+	logger := log.New()
+
+	shared, ok := hub.Get(id)
+	if !ok {
+		logger.Print(fmt.Sprintf("User %s tried to join session %s which is not shared", user, id))
+		exitWithError(sess, fmt.Errorf("session not found: %s", id))
+		return
+	}
+
+	// The key was checked during authentication, but the session might have ended and its ID been reused since.
+	if _, err := authorizer.User(shared.Namespace, user, sess.PublicKey()); err != nil {
+		logger.Print(fmt.Sprintf("User %s is not allowed to join session %s in namespace %s", user, id, shared.Namespace))
+		exitWithError(sess, fmt.Errorf("not allowed to join session: %s", id))
+		return
+	}
+
+	if mode == shareReadWrite && shared.Mode != shareReadWrite {
+		logger.Print(fmt.Sprintf("Refused read-write access for user %s to session %s, it is shared read-only", user, id))
+		exitWithError(sess, fmt.Errorf("session is shared read-only, join with: %s", joinReadOnly+joinSeparator+id+joinSeparator+user))
+		return
+	}
+
+	if _, _, isPty := sess.Pty(); !isPty {
+		exitWithError(sess, fmt.Errorf("a terminal is required to join a session, connect using: ssh -t"))
+		return
+	}
+
+	logger.Print(fmt.Sprintf("User %s joined session %s of user %s in namespace %s (%s) from %s", user, id, shared.Owner, shared.Namespace, shareModeName(mode), sess.RemoteAddr()))
+
+	event := audit.Event{
+		Type:        audit.TypeSessionJoin,
+		Session:     id,
+		User:        user,
+		Fingerprint: fingerprint(sess.PublicKey()),
+		RemoteAddr:  sess.RemoteAddr().String(),
+		Namespace:   shared.Namespace,
+	}
+	auditor.Emit(event)
+
+	if mode == shareReadOnly {
+		fmt.Fprintf(sess, "Watching session %s of user %s, press Ctrl-C to leave\r\n", id, shared.Owner)
+	} else {
+		fmt.Fprintf(sess, "Joined session %s of user %s, disconnect with ~. to leave\r\n", id, shared.Owner)
+	}
+
+	err := shared.Attach(sess, mode)
+
+	logger.Print(fmt.Sprintf("User %s left session %s of user %s in namespace %s", user, id, shared.Owner, shared.Namespace))
+
+	event.Type = audit.TypeSessionLeave
+	auditor.Emit(event)
+
+	if err != nil {
+		fmt.Fprintf(sess, "\r\nLeft session %s: %s\r\n", id, err.Error())
+	}
+
+	sess.Exit(0)
+}
+
+// Helper function to reattach a user to a session which kept running after they disconnected.
+func resumeSession(sess ssh.Session, sessions *ResumableSessions, authorizer *Authorizer, token, user string) {
+	// Generate a unique ID for this connection.
+	// This will be used for logging connections.
+	logger := log.New()
+
+	resumable, ok := sessions.Get(token)
+	if !ok || resumable.User != user {
+		logger.Print(fmt.Sprintf("User %s tried to resume a session which was not found", user))
+		exitWithError(sess, fmt.Errorf("session not found, it might have ended or the grace period has passed"))
+		return
+	}
+
+	if _, err := authorizer.User(resumable.Namespace, user, sess.PublicKey()); err != nil {
+		logger.Print(fmt.Sprintf("User %s is not allowed to resume session %s in namespace %s", user, resumable.ID, resumable.Namespace))
+		exitWithError(sess, fmt.Errorf("not allowed to resume session"))
+		return
+	}
+
+	if _, _, isPty := sess.Pty(); !isPty {
+		exitWithError(sess, fmt.Errorf("a terminal is required to resume a session, connect using: ssh -t"))
+		return
+	}
+
+	logger.Print(fmt.Sprintf("User %s resumed session %s in namespace %s from %s", user, resumable.ID, resumable.Namespace, sess.RemoteAddr()))
+
+	// The exit status is sent by the session's handler, if the command exits while the user is attached.
+	leaveResumable(sess, resumable, resumable.Attach(sess, true), logger, user)
+}
+
+// Helper function to close a client's connection once it is no longer attached to a resumable
+// session, telling it how to resume if it was dropped for not keeping up with the output.
+func leaveResumable(sess ssh.Session, resumable *ResumableSession, released <-chan error, logger log.Log, user string) {
+	if err := <-released; err != nil {
+		logger.Print(fmt.Sprintf("User %s was dropped from session %s in namespace %s for not keeping up with its output", user, resumable.ID, resumable.Namespace))
+		fmt.Fprintf(sess, "\r\nLeft session %s: %s, resume it with: %s\r\n", resumable.ID, err.Error(), resumeUsage(resumable.Token, user))
+		sess.Exit(exitCodeGateway)
+		return
+	}
+
+	if !resumable.Finished() {
+		logger.Print(fmt.Sprintf("User %s detached from session %s in namespace %s", user, resumable.ID, resumable.Namespace))
+		fmt.Fprintf(sess, "\r\nSession %s was resumed by another connection\r\n", resumable.ID)
+		sess.Exit(0)
+	}
+}
+
+// Helper function to describe a mode for logs and messages.
+func shareModeName(mode string) string {
+	if mode == shareReadWrite {
+		return "read-write"
+	}
+
+	return "read-only"
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -8,8 +9,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/gliderlabs/ssh"
@@ -17,23 +21,109 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 	"k8s.io/api/core/v1"
 	apiextcs "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/tools/cache"
 
+	"github.com/previousnext/k8s-ssh/audit"
 	"github.com/previousnext/k8s-ssh/client"
 	"github.com/previousnext/k8s-ssh/crd"
+	"github.com/previousnext/k8s-ssh/recording"
+	"github.com/previousnext/k8s-ssh/sftp"
 	"github.com/previousnext/log"
 )
 
 var (
-	cliListen = kingpin.Flag("listen", "Port to receive SSH requests").Default(":22").OverrideDefaultFromEnvar("SSH_LISTEN").String()
-	cliSigner = kingpin.Flag("signer", "Path to signer certificate").OverrideDefaultFromEnvar("SSH_SIGNER").String()
-	cliShell  = kingpin.Flag("shell", "Shell type to use if the user requests a Shell session").Default("/bin/bash").OverrideDefaultFromEnvar("SSH_SHELL").String()
-	cliK8s    = kingpin.Flag("k8s", "K8s endpoint. If left blank we assume this is 'in cluster' and using K8s native auth").String()
+	cliListen       = kingpin.Flag("listen", "Port to receive SSH requests").Default(":22").OverrideDefaultFromEnvar("SSH_LISTEN").String()
+	cliSigner       = kingpin.Flag("signer", "Path to signer certificate").OverrideDefaultFromEnvar("SSH_SIGNER").String()
+	cliShell        = kingpin.Flag("shell", "Shell type to use if the user requests a Shell session").Default("/bin/bash").OverrideDefaultFromEnvar("SSH_SHELL").String()
+	cliCommandShell = kingpin.Flag("command-shell", "Run commands with the shell eg. 'bash -c <command>' instead of executing them directly").Default("true").OverrideDefaultFromEnvar("SSH_COMMAND_SHELL").Bool()
+	cliEnv          = kingpin.Flag("env", "Comma separated list of environment variables which clients can send eg. LC_*").Default("TERM,LANG,LC_*,COLORTERM").OverrideDefaultFromEnvar("SSH_ENV").String()
+	cliKillOrphans  = kingpin.Flag("kill-orphans", "Terminate commands which are still running in the container when a client disconnects").OverrideDefaultFromEnvar("SSH_KILL_ORPHANS").Bool()
+	cliIdleTimeout  = kingpin.Flag("idle-timeout", "Close sessions which have had no input or output for this long, can be overridden with the ssh.skpr.io/idle-timeout namespace annotation").Default("0s").OverrideDefaultFromEnvar("SSH_IDLE_TIMEOUT").Duration()
+	cliMaxDuration  = kingpin.Flag("max-duration", "Close sessions which have been open for this long, can be overridden with the ssh.skpr.io/max-duration namespace annotation").Default("0s").OverrideDefaultFromEnvar("SSH_MAX_DURATION").Duration()
+	cliWarning      = kingpin.Flag("timeout-warning", "How long before a session is closed to warn the user").Default("1m").OverrideDefaultFromEnvar("SSH_TIMEOUT_WARNING").Duration()
+	cliSftpServer   = kingpin.Flag("sftp-server", "Comma separated list of paths to look for sftp-server in the container, a built in server is used if it is not found").Default("/usr/lib/openssh/sftp-server,/usr/lib/ssh/sftp-server,/usr/libexec/openssh/sftp-server,/usr/libexec/sftp-server").OverrideDefaultFromEnvar("SSH_SFTP_SERVER").String()
+	cliForwardPorts = kingpin.Flag("forward-ports", "Ports each group can forward to with 'ssh -L' or 'ssh -D' eg. 'dev=5432,6379 admin=*', forwarding is disabled if empty").OverrideDefaultFromEnvar("SSH_FORWARD_PORTS").String()
+	cliReverse      = kingpin.Flag("reverse-forwarding", "Allow clients to expose ports inside their namespace with 'ssh -R', can be overridden with the ssh.skpr.io/reverse-forwarding namespace annotation").Default("true").OverrideDefaultFromEnvar("SSH_REVERSE_FORWARDING").Bool()
+	cliAgent        = kingpin.Flag("agent-forwarding", "Allow clients to forward their agent into containers with 'ssh -A', can be overridden with the ssh.skpr.io/agent-forwarding namespace annotation or the agentForwarding field of a user").OverrideDefaultFromEnvar("SSH_AGENT_FORWARDING").Bool()
+	cliResumeGrace  = kingpin.Flag("resume-grace", "How long to keep sessions with a terminal running after the client disconnects, so they can be resumed, disabled if zero").Default("0s").OverrideDefaultFromEnvar("SSH_RESUME_GRACE").Duration()
+	cliResumeBuffer = kingpin.Flag("resume-buffer", "How much output to keep for clients who resume a session").Default("256KB").OverrideDefaultFromEnvar("SSH_RESUME_BUFFER").Bytes()
+	cliRecord       = kingpin.Flag("record", "Record sessions with a terminal in the asciicast format, can be overridden with the ssh.skpr.io/record namespace annotation").OverrideDefaultFromEnvar("SSH_RECORD").Bool()
+	cliRecordDir    = kingpin.Flag("record-dir", "Directory to store session recordings in, when using local or volume storage").Default("/var/lib/k8s-ssh/recordings").OverrideDefaultFromEnvar("SSH_RECORD_DIR").String()
+	cliRecordStore  = kingpin.Flag("record-storage", "Where to store session recordings (local: a directory, volume: a directory with a size limit eg. a PersistentVolumeClaim, s3: an S3 compatible object store)").Default(recordStorageLocal).OverrideDefaultFromEnvar("SSH_RECORD_STORAGE").Enum(recordStorageLocal, recordStorageVolume, recordStorageS3)
+	cliRecordMax    = kingpin.Flag("record-max-size", "Total size of the recordings kept with volume storage, the oldest are removed first").Default("10GB").OverrideDefaultFromEnvar("SSH_RECORD_MAX_SIZE").Bytes()
+	cliRecordKeep   = kingpin.Flag("record-retention", "How long to keep session recordings, they are kept forever if zero").Default("0s").OverrideDefaultFromEnvar("SSH_RECORD_RETENTION").Duration()
+	cliS3Endpoint   = kingpin.Flag("record-s3-endpoint", "Endpoint of the object store for recordings eg. https://s3.ap-southeast-2.amazonaws.com").OverrideDefaultFromEnvar("SSH_RECORD_S3_ENDPOINT").String()
+	cliS3Region     = kingpin.Flag("record-s3-region", "Region of the bucket for recordings").Default("us-east-1").OverrideDefaultFromEnvar("SSH_RECORD_S3_REGION").String()
+	cliS3Bucket     = kingpin.Flag("record-s3-bucket", "Bucket to store recordings in").OverrideDefaultFromEnvar("SSH_RECORD_S3_BUCKET").String()
+	cliS3Prefix     = kingpin.Flag("record-s3-prefix", "Prefix for the keys of recordings eg. recordings/").OverrideDefaultFromEnvar("SSH_RECORD_S3_PREFIX").String()
+	cliS3AccessKey  = kingpin.Flag("record-s3-access-key", "Access key for the bucket").OverrideDefaultFromEnvar("SSH_RECORD_S3_ACCESS_KEY").String()
+	cliS3SecretKey  = kingpin.Flag("record-s3-secret-key", "Secret key for the bucket").OverrideDefaultFromEnvar("SSH_RECORD_S3_SECRET_KEY").String()
+	cliAuditStdout  = kingpin.Flag("audit-stdout", "Write audit events to stdout as JSON lines").OverrideDefaultFromEnvar("SSH_AUDIT_STDOUT").Bool()
+	cliAuditFile    = kingpin.Flag("audit-file", "File to write audit events to as JSON lines, it is rotated once it reaches --audit-file-max-size").OverrideDefaultFromEnvar("SSH_AUDIT_FILE").String()
+	cliAuditFileMax = kingpin.Flag("audit-file-max-size", "Size the audit file is rotated at").Default("100MB").OverrideDefaultFromEnvar("SSH_AUDIT_FILE_MAX_SIZE").Bytes()
+	cliAuditBackups = kingpin.Flag("audit-file-backups", "How many rotated audit files to keep").Default("5").OverrideDefaultFromEnvar("SSH_AUDIT_FILE_BACKUPS").Int()
+	cliAuditSyslog  = kingpin.Flag("audit-syslog", "Syslog server to send audit events to in the RFC 5424 format eg. udp://syslog:514, tcp://syslog:601, tls://syslog:6514 or unix:///dev/log").OverrideDefaultFromEnvar("SSH_AUDIT_SYSLOG").String()
+	cliAuditWebhook = kingpin.Flag("audit-webhook", "URL to POST batches of audit events to as a JSON array").OverrideDefaultFromEnvar("SSH_AUDIT_WEBHOOK").String()
+	cliAuditBatch   = kingpin.Flag("audit-webhook-batch", "Most audit events to send to the webhook in one request").Default("100").OverrideDefaultFromEnvar("SSH_AUDIT_WEBHOOK_BATCH").Int()
+	cliAuditFlush   = kingpin.Flag("audit-webhook-interval", "Longest to wait before sending a partial batch of audit events to the webhook").Default("5s").OverrideDefaultFromEnvar("SSH_AUDIT_WEBHOOK_INTERVAL").Duration()
+	cliAuditChain   = kingpin.Flag("audit-chain", "Add a sequence number and the hash of the previous event to each audit event, with checkpoints signed by the host key from --signer, so the log can be checked with the verify command").OverrideDefaultFromEnvar("SSH_AUDIT_CHAIN").Bool()
+	cliAuditSign    = kingpin.Flag("audit-checkpoint-interval", "How often to sign a checkpoint of the audit events since the last one").Default("5m").OverrideDefaultFromEnvar("SSH_AUDIT_CHECKPOINT_INTERVAL").Duration()
+	cliPodEvents    = kingpin.Flag("pod-events", "Record Kubernetes Events against pods when sessions start, end or fail").Default("true").OverrideDefaultFromEnvar("SSH_POD_EVENTS").Bool()
+	cliEventsQPS    = kingpin.Flag("pod-events-qps", "How many sessions per second to record events for, sessions over the limit are skipped").Default("1").OverrideDefaultFromEnvar("SSH_POD_EVENTS_QPS").Float32()
+	cliEventsBurst  = kingpin.Flag("pod-events-burst", "How many sessions to record events for in a burst, before --pod-events-qps applies").Default("25").OverrideDefaultFromEnvar("SSH_POD_EVENTS_BURST").Int()
+	cliHTTPListen   = kingpin.Flag("http-listen", "Address to serve metrics (/metrics) and health checks (/healthz, /readyz) on, disabled if empty").Default(":9090").OverrideDefaultFromEnvar("SSH_HTTP_LISTEN").String()
+	cliShutdown     = kingpin.Flag("shutdown-timeout", "How long to wait for sessions to finish after SIGTERM before closing them, leave a few seconds of the pod's terminationGracePeriodSeconds for them to clean up").Default("25s").OverrideDefaultFromEnvar("SSH_SHUTDOWN_TIMEOUT").Duration()
+	cliPodIP        = kingpin.Flag("pod-ip", "IP of the gateway pod, which services for reverse port forwards point to").OverrideDefaultFromEnvar("SSH_POD_IP").String()
+	cliK8s          = kingpin.Flag("k8s", "K8s endpoint. If left blank we assume this is 'in cluster' and using K8s native auth").String()
+
+	cliRouter      = kingpin.Flag("router", "How the target pod is chosen (tilde: namespace~pod~container~user, dot: namespace.pod.container.user, slash: namespace/pod/container/user, env: sent with SendEnv, menu: interactive menu)").Default(routerTilde).OverrideDefaultFromEnvar("SSH_ROUTER").Enum(routerTilde, routerDot, routerSlash, routerEnv, routerMenu)
+	cliRouterEnv   = kingpin.Flag("router-env", "Environment variable which holds the target when using the env router").Default("K8S_TARGET").OverrideDefaultFromEnvar("SSH_ROUTER_ENV").String()
+	cliSidecars    = kingpin.Flag("sidecars", "Comma separated list of sidecar containers which are skipped when a container is not provided").Default("istio-proxy,linkerd-proxy,cloudsql-proxy").OverrideDefaultFromEnvar("SSH_SIDECARS").String()
+	cliPodStrategy = kingpin.Flag("pod-strategy", "How to pick a pod when targeting a workload eg. deploy/web (random, oldest, sessions)").Default(podStrategyRandom).OverrideDefaultFromEnvar("SSH_POD_STRATEGY").Enum(podStrategyRandom, podStrategyOldest, podStrategySessions)
+)
+
+var (
+	cmdServe = kingpin.Command("serve", "Run the SSH server").Default()
+
+	// This is run inside containers by the server, to forward the client's agent.
+	cmdAgentRelay       = kingpin.Command("agent-relay", "Relay connections from an agent socket over stdin and stdout").Hidden()
+	cmdAgentRelaySocket = cmdAgentRelay.Arg("socket", "Path of the agent socket").Required().String()
+
+	cmdVerify      = kingpin.Command("verify", "Check audit logs written with --audit-chain for events which were modified, removed or reordered")
+	cmdVerifyKey   = cmdVerify.Flag("key", "Public or private host key of the server, checkpoints signed by any other key are reported").Required().String()
+	cmdVerifyFiles = cmdVerify.Arg("files", "Audit logs, oldest first eg. audit.log.2 audit.log.1 audit.log").Required().ExistingFiles()
 )
 
 func main() {
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case cmdAgentRelay.FullCommand():
+		if err := runAgentRelay(*cmdAgentRelaySocket); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case cmdVerify.FullCommand():
+		if err := runVerify(*cmdVerifyFiles, *cmdVerifyKey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case cmdServe.FullCommand():
+		serve()
+	}
+}
+
+// Helper function to run the SSH server.
+func serve() {
+	// The gateway is not ready for connections until the users have been loaded and it is listening.
+	ready := NewReadiness()
+	crdEstablished := ready.Pending("crd")
+	listening := ready.Pending("ssh")
+
+	if *cliHTTPListen != "" {
+		go serveHTTP(*cliHTTPListen, ready)
+	}
 
 	promlog.Info("Installing CRD:", crd.FullCRDName)
 
@@ -50,170 +140,750 @@ func main() {
 		// This must be an deployed to the cluster.
 		config, err = rest.InClusterConfig()
 		if err != nil {
-			panic(err)
+			promlog.Fatalf("Failed to load the in cluster config: %s", err)
 		}
 	}
 
 	clientset, err := apiextcs.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		promlog.Fatalf("Failed to create the API extensions client: %s", err)
 	}
 
 	err = crd.Create(clientset)
 	if err != nil {
-		panic(err)
+		promlog.Fatalf("Failed to install the CRD: %s", err)
 	}
 
+	// Users can't be loaded until the API server is serving the CRD.
+	err = wait.PollImmediate(time.Second, time.Minute, func() (bool, error) {
+		return crd.Established(clientset)
+	})
+	if err != nil {
+		promlog.Fatalf("Failed waiting for the CRD to be established: %s", err)
+	}
+
+	crdEstablished()
+
 	crdcs, scheme, err := crd.NewClient(config)
 	if err != nil {
-		panic(err)
+		promlog.Fatalf("Failed to create the CRD client: %s", err)
 	}
 
+	k8sclient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		promlog.Fatalf("Failed to create the Kubernetes client: %s", err)
+	}
+
+	sessions := NewSessionCounter()
+	pods := NewPodResolver(k8sclient, *cliPodStrategy, sessions)
+	containers := NewContainerResolver(k8sclient, strings.Split(*cliSidecars, ","))
+	authorizer := NewAuthorizer(crdcs, scheme)
+	ready.Add("users", authorizer.HasSynced)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go authorizer.Run(stop)
+
+	policies := NewPolicyLoader(k8sclient, Policy{
+		IdleTimeout: *cliIdleTimeout,
+		MaxDuration: *cliMaxDuration,
+
+		ReverseForwarding: *cliReverse,
+		AgentForwarding:   *cliAgent,
+		Record:            *cliRecord,
+	})
+
+	ports, err := parsePortPolicy(*cliForwardPorts)
+	if err != nil {
+		promlog.Fatalf("Failed to parse the port forwarding policy: %s", err)
+	}
+
+	// Check if a signer was provided, if one was, load it. It also signs audit checkpoints.
+	var signer ssh.Signer
+
+	if *cliSigner != "" {
+		signer, err = getSigner(*cliSigner)
+		if err != nil {
+			promlog.Fatalf("Failed to load the signer: %s", err)
+		}
+	}
+
+	auditor, err := newAuditor(AuditConfig{
+		Stdout:          *cliAuditStdout,
+		File:            *cliAuditFile,
+		FileMaxSize:     int64(*cliAuditFileMax),
+		FileBackups:     *cliAuditBackups,
+		Syslog:          *cliAuditSyslog,
+		Webhook:         *cliAuditWebhook,
+		WebhookBatch:    *cliAuditBatch,
+		WebhookInterval: *cliAuditFlush,
+
+		Chain:              *cliAuditChain,
+		Signer:             signer,
+		CheckpointInterval: *cliAuditSign,
+	})
+	if err != nil {
+		promlog.Fatalf("Failed to set up the audit log: %s", err)
+	}
+
+	var events *PodEvents
+	if *cliPodEvents {
+		events = NewPodEvents(k8sclient, *cliEventsQPS, *cliEventsBurst)
+	}
+
+	forwarder := NewForwarder(config, k8sclient, pods, authorizer, ports, auditor)
+	reverse := NewReverseForwarder(k8sclient, authorizer, forwarder, policies, auditor, *cliPodIP)
+
+	if err := reverse.Cleanup(); err != nil {
+		promlog.Info("Failed to remove leftover reverse port forwards:", err)
+	}
+	agents := NewAgentForwarder()
+	envs := NewEnvChecker()
+	hub := NewSessionHub()
+	resumables := NewResumableSessions()
+
+	var recordings recording.Storage
+
+	switch *cliRecordStore {
+	case recordStorageVolume:
+		recordings = recording.NewVolumeStorage(*cliRecordDir, int64(*cliRecordMax))
+	case recordStorageS3:
+		recordings, err = recording.NewS3Storage(recording.S3Config{
+			Endpoint:  *cliS3Endpoint,
+			Region:    *cliS3Region,
+			Bucket:    *cliS3Bucket,
+			Prefix:    *cliS3Prefix,
+			AccessKey: *cliS3AccessKey,
+			SecretKey: *cliS3SecretKey,
+		})
+		if err != nil {
+			promlog.Fatalf("Failed to set up S3 recording storage: %s", err)
+		}
+	default:
+		recordings = recording.NewLocalStorage(*cliRecordDir)
+	}
+
+	if *cliRecordKeep > 0 {
+		go pruneRecordings(recordings, *cliRecordKeep)
+	}
+
+	var router Router
+
+	switch *cliRouter {
+	case routerDot:
+		router = NewSeparatorRouter(".")
+	case routerSlash:
+		router = NewSeparatorRouter("/")
+	case routerEnv:
+		router = NewEnvRouter(*cliRouterEnv)
+	case routerMenu:
+		router = NewMenuRouter(authorizer, pods)
+	default:
+		router = NewSeparatorRouter("~")
+	}
+
+	drainer := NewDrainer()
+
 	promlog.Info("Starting SSH Server")
 
 	srv := &ssh.Server{
 		Addr: *cliListen,
 	}
 
-	ssh.Handle(func(sess ssh.Session) {
+	handler := func(sess ssh.Session) {
 		// Generate a unique ID for this request.
 		// This will be used for logging connections.
 		logger := log.New()
 
-		namespace, pod, container, user, err := splitUser(sess.User())
+		// This will handle users joining a session which has been shared with them.
+		if id, user, mode, ok := parseJoinUsername(sess.User()); ok {
+			joinSession(sess, hub, authorizer, auditor, id, user, mode)
+			return
+		}
+
+		// This will handle users reattaching to a session after they were disconnected.
+		if token, user, ok := parseResumeUsername(sess.User()); ok {
+			resumeSession(sess, resumables, authorizer, token, user)
+			return
+		}
+
+		_, _, isPty := sess.Pty()
+
+		// Sessions with a terminal can be resumed if a grace period is set, so they are not torn down when the client disconnects.
+		resume := *cliResumeGrace > 0 && isPty && sess.Subsystem() == ""
+
+		var parent context.Context = sess.Context()
+		if resume {
+			parent = context.Background()
+		}
+
+		// Everything started for this session is torn down when the client disconnects or the session ends.
+		ctx, cancel := context.WithCancel(parent)
+		defer cancel()
+
+		target, err := router.Target(sess)
 		if err != nil {
-			logger.Print(fmt.Sprintf("Failed to get namespace, pod and container from user: %s", user))
+			logger.Print(fmt.Sprintf("Failed to get namespace, pod and container for user: %s", sess.User()))
+			exitWithError(sess, err)
+			return
+		}
 
-			// Return the error code output to the end user so they can see why the request failed.
-			io.WriteString(sess, err.Error())
+		namespace, container, user := target.Namespace, target.Container, target.User
 
-			// This will send an error code back to the SSH client.
-			sess.Exit(1)
+		// The namespace might not have been known during authentication, so the key is checked against it again.
+		sshUser, err := authorizer.User(namespace, user, sess.PublicKey())
+		if err != nil {
+			logger.Print(fmt.Sprintf("User %s is not allowed to connect to namespace %s", user, namespace))
+			exitWithError(sess, fmt.Errorf("not allowed to connect to namespace: %s", namespace))
+			return
+		}
 
+		pod, err := pods.Resolve(namespace, target.Pod)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to resolve pod '%s' for user %s: %s", target.Pod, user, err.Error()))
+			exitWithError(sess, err)
 			return
 		}
 
-		logger.Print(fmt.Sprintf("Starting connection for user: %s", user))
+		if container == "" {
+			container, err = containers.Resolve(sess, namespace, pod)
+			if err != nil {
+				logger.Print(fmt.Sprintf("Failed to resolve container for pod %s for user %s: %s", pod, user, err.Error()))
+				exitWithError(sess, err)
+				return
+			}
+		}
 
-		// These are default options which will be sent to the Kubernetes API.
-		cmd := &v1.PodExecOptions{
-			Container: container,
-			Stdout:    true,
-			Stderr:    true,
-			Command:   sess.Command(),
+		// Sessions are refused rather than falling back to the defaults, which might not record or time out.
+		policy, err := policies.Load(namespace)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Refused connection for user %s, failed to load policy for namespace %s: %s", user, namespace, err.Error()))
+			exitWithError(sess, fmt.Errorf("failed to load policy for namespace %s: %s", namespace, err))
+			return
 		}
-		opts := remotecommand.StreamOptions{
-			Stdout: sess,
-			Stderr: sess.Stderr(),
+
+		defer sessions.Add(namespace, pod)()
+
+		logger.Print(fmt.Sprintf("Starting connection for user %s to pod %s", user, pod))
+
+		audited := NewSessionAudit(auditor, audit.Event{
+			Session:     logger.ID(),
+			User:        user,
+			Fingerprint: fingerprint(sess.PublicKey()),
+			RemoteAddr:  sess.RemoteAddr().String(),
+			Namespace:   namespace,
+			Pod:         pod,
+			Container:   container,
+		})
+		defer func() {
+			events.Ended(audited.End())
+		}()
+
+		// The command the client asked for, or the shell if it did not ask for one.
+		command := sess.RawCommand()
+		if command == "" && sess.Subsystem() == "" {
+			command = *cliShell
 		}
 
-		// This will handle "shell" calls.
-		if isShell(cmd.Command) {
+		audited.Command(command, sess.Subsystem())
+		events.Started(audited.Event())
+
+		ptyReq, winCh, _ := sess.Pty()
+
+		// These are the options which will be sent to the Kubernetes API, for shells, commands, rsync and scp.
+		cmd, opts, kind := sessionCommand(sess, container, *cliShell, *cliCommandShell)
+
+		switch kind {
+		case sessionTypeShell:
 			logger.Print(fmt.Sprintf("Detected SHELL for: %s", user))
+		case sessionTypeRsync:
+			logger.Print(fmt.Sprintf("Detected rsync mode for: %s", user))
+		case sessionTypeScp:
+			logger.Print(fmt.Sprintf("Detected scp mode for: %s", user))
+		}
+
+		crdclient := client.Client(crdcs, scheme, namespace)
+
+		execURL := func(cmd *v1.PodExecOptions) *url.URL {
+			return crdclient.URL(pod, container, cmd)
+		}
+
+		runner := NewPodRunner(ctx, config, execURL)
+		executor := podExecutor(config, execURL)
 
-			// Provide a fully featured shell from the remote environment.
-			cmd.Command = []string{
-				*cliShell,
+		// This will handle sftp support, using the container's sftp-server if it has one.
+		var sftpBuiltin bool
+
+		if sess.Subsystem() == subsystemSFTP {
+			kind = sessionTypeSftp
+
+			if path := findSftpServer(runner, strings.Split(*cliSftpServer, ",")); path != "" {
+				logger.Print(fmt.Sprintf("Detected sftp mode for: %s", user))
+				cmd.Command = []string{path}
+			} else {
+				logger.Print(fmt.Sprintf("Detected sftp mode for: %s, using the built in server", user))
+				sftpBuiltin = true
 			}
 
-			cmd.Stdin = true
-			opts.Stdin = sess
+			binaryMode(cmd, &opts)
+		}
+
+		untrack := trackSession(namespace, kind)
+		defer func() {
+			untrack(audited.Bytes())
+		}()
 
-			cmd.TTY = true
-			opts.Tty = true
+		// Pass through the client's terminal and locale settings, along with who is connected.
+		env := filterEnv(sess.Environ(), strings.Split(*cliEnv, ","))
+		if isPty && ptyReq.Term != "" {
+			env = append(env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 		}
+		env = append(env, fmt.Sprintf("%s=%s", envUser, user), fmt.Sprintf("%s=%s", envSessionID, logger.ID()))
 
-		// This will handle rsync support eg. stdin for syncing.
-		if isRsync(cmd.Command) {
-			logger.Print(fmt.Sprintf("Detected rsync mode for: %s", user))
-			cmd.Stdin = true
-			opts.Stdin = sess
+		// This will handle agent forwarding, if the client asked for it and it is allowed for the user.
+		if ssh.AgentRequested(sess) && !sftpBuiltin {
+			enabled := policy.AgentForwarding
+			if sshUser.Spec.AgentForwarding != nil {
+				enabled = *sshUser.Spec.AgentForwarding
+			}
 
-			opts.Tty = false
-			cmd.TTY = false
+			if enabled {
+				socket, err := agents.Forward(ctx, sess, runner, logger.ID())
+				if err != nil {
+					logger.Print(fmt.Sprintf("Failed to forward agent for user %s, continuing without it: %s", user, err.Error()))
+				} else {
+					logger.Print(fmt.Sprintf("Forwarding agent for user %s to %s", user, socket))
+					env = append(env, fmt.Sprintf("SSH_AUTH_SOCK=%s", socket))
+				}
+			} else {
+				logger.Print(fmt.Sprintf("Refused agent forwarding for user %s in namespace %s", user, namespace))
+			}
 		}
 
-		if cmd.TTY {
-			sizeQueue := NewResizeQueue(sess)
-			opts.TerminalSizeQueue = sizeQueue
+		pidFile := orphanPidFile(logger.ID())
+		if *cliKillOrphans {
+			cmd.Command = orphanCommand(pidFile, cmd.Command)
 		}
 
-		crdclient := client.Client(crdcs, scheme, namespace)
+		// The built in sftp server does not run a command in the container.
+		if !sftpBuiltin {
+			if envs.Supported(runner) {
+				cmd.Command = envCommand(env, cmd.Command)
+			} else {
+				logger.Print(fmt.Sprintf("Container %s in pod %s does not have the env command, running without environment variables", container, pod))
+			}
+		}
+
+		// This will handle resumable sessions, the command keeps running for the grace period if the client disconnects.
+		var resumable *ResumableSession
+
+		if resume && cmd.TTY {
+			token, err := resumeToken()
+			if err != nil {
+				audited.Fail(err)
+				exitWithError(sess, err)
+				return
+			}
+
+			resumable = NewResumableSession(logger.ID(), token, namespace, user, *cliResumeGrace, int(*cliResumeBuffer), func() {
+				logger.Print(fmt.Sprintf("Closing session for user %s to pod %s, it was not resumed within %s", user, pod, *cliResumeGrace))
+				audited.Closed("not resumed")
+				cancel()
+			})
+
+			// The client which started the session is told how to resume it if it is dropped for
+			// being slow, the command keeps running for the grace period.
+			go leaveResumable(sess, resumable, resumable.Attach(sess, false), logger, user)
+			opts.Stdin = resumable.Stdin()
+			opts.Stdout = resumable
+
+			resumables.Add(resumable)
+			defer func() {
+				resumables.Remove(resumable)
+				resumable.Finish(nil)
+			}()
+
+			fmt.Fprintf(sess.Stderr(), "Resume this session if you are disconnected with: %s\r\n", resumeUsage(token, user))
+		} else if resume {
+			// Only sessions with a terminal can be resumed.
+			go func() {
+				select {
+				case <-sess.Context().Done():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		// Exit statuses are sent to whichever client is attached when the command exits.
+		finish := func(exit func(ssh.Session)) {
+			if resumable != nil {
+				resumable.Finish(exit)
+				return
+			}
 
-		exec, err := remotecommand.NewExecutor(config, "POST", crdclient.URL(pod, container, cmd))
+			exit(sess)
+		}
+
+		// This will handle sharing the session, everyone who joins sees the same output.
+		mode, share, err := shareMode(sess.Environ())
 		if err != nil {
-			logger.Print(fmt.Sprintf("Failed to run command '%s' as %s: %s", strings.Join(cmd.Command, " "), user, err.Error()))
+			audited.Fail(err)
+			exitWithError(sess, err)
+			return
+		}
+
+		var shared *SharedSession
+
+		if share && cmd.TTY {
+			window, windows := ptyReq.Window, winCh
+			if resumable != nil {
+				window, windows = resumable.Window(), resumable.Windows()
+			}
+
+			shared = NewSharedSession(logger.ID(), namespace, user, mode, opts.Stdin, window, windows)
+			opts.Stdin = shared.Stdin()
+			opts.Stdout = shared.Output(opts.Stdout)
+
+			hub.Publish(shared)
+			defer func() {
+				hub.Remove(shared.ID)
+				shared.Close()
+			}()
+
+			logger.Print(fmt.Sprintf("Sharing session for user %s in namespace %s (%s)", user, namespace, shareModeName(mode)))
 
-			// Return the error code output to the end user so they can see why the request failed.
-			io.WriteString(sess, err.Error())
+			join := joinReadOnly
+			if mode == shareReadWrite {
+				join = joinReadWrite
+			}
+
+			fmt.Fprintf(sess.Stderr(), "Sharing session %s (%s), other users can join with: ssh -t %s@<host>\r\n", logger.ID(), shareModeName(mode), join+joinSeparator+logger.ID()+joinSeparator+"<user>")
+		} else if share {
+			logger.Print(fmt.Sprintf("Not sharing session for user %s, only sessions with a terminal can be shared", user))
+		}
 
-			// This will send an error code back to the SSH client.
-			sess.Exit(1)
+		// This will handle recording, the input, output and window size the command sees are recorded.
+		var recorder *recording.Recorder
+
+		if policy.Record && cmd.TTY {
+			window := ptyReq.Window
+			if shared != nil {
+				window = shared.Window()
+			} else if resumable != nil {
+				window = resumable.Window()
+			}
+
+			var path string
+
+			recorder, path, err = startRecording(recordings, recording.Header{
+				Width:   window.Width,
+				Height:  window.Height,
+				Command: command,
+				Title:   fmt.Sprintf("%s@%s/%s", user, namespace, pod),
+				Env: map[string]string{
+					"TERM":  ptyReq.Term,
+					"SHELL": *cliShell,
+				},
+				Session: recording.Session{
+					ID:          logger.ID(),
+					User:        user,
+					Fingerprint: fingerprint(sess.PublicKey()),
+					Namespace:   namespace,
+					Pod:         pod,
+					Container:   container,
+					RemoteAddr:  sess.RemoteAddr().String(),
+				},
+			})
+			if err != nil {
+				// Sessions which must be recorded are not allowed to continue without a recording.
+				logger.Print(fmt.Sprintf("Failed to start recording for user %s: %s", user, err.Error()))
+				audited.Fail(err)
+				exitWithError(sess, fmt.Errorf("failed to start recording"))
+				return
+			}
+
+			defer func() {
+				if err := recorder.Close(); err != nil {
+					logger.Print(fmt.Sprintf("Failed to write recording %s: %s", path, err.Error()))
+				}
+			}()
+
+			opts.Stdin = recorder.Reader(opts.Stdin)
+			opts.Stdout = recorder.Writer(opts.Stdout)
+
+			logger.Print(fmt.Sprintf("Recording session for user %s to %s", user, path))
+		}
+
+		// Close the session if it is left idle or open for too long.
+		watchdog := NewWatchdog(policy.IdleTimeout, policy.MaxDuration, *cliWarning)
+		opts.Stdin = watchdog.Reader(opts.Stdin)
+		opts.Stdout = watchdog.Writer(opts.Stdout)
+		opts.Stderr = watchdog.Writer(opts.Stderr)
+
+		// Count what is sent each way for the audit log.
+		opts.Stdin = audited.Reader(opts.Stdin)
+		opts.Stdout = audited.Writer(opts.Stdout)
+		opts.Stderr = audited.Writer(opts.Stderr)
+
+		var warn io.Writer = sess.Stderr()
+		if resumable != nil {
+			warn = resumable
+		}
 
+		expire := func(reason string) {
+			logger.Print(fmt.Sprintf("Closing session for user %s to pod %s due to %s", user, pod, reason))
+			audited.Closed(reason)
+			cancel()
+		}
+
+		go watchdog.Watch(ctx, warn, expire)
+
+		// Sessions which must be recorded are not allowed to continue once the recording fails eg. an upload to the object store.
+		if recorder != nil {
+			go func() {
+				select {
+				case <-recorder.Failed():
+					if watchdog.Close(warn, timeoutRecording) {
+						expire(timeoutRecording)
+					}
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		// Users are warned when the server starts shutting down, and the session is closed if it is still running once it has drained.
+		defer drainer.Add(warn, func(reason string) {
+			if watchdog.Close(warn, reason) {
+				expire(reason)
+			}
+		})()
+
+		if sftpBuiltin {
+			// Closing the session unblocks the server if it is closed by the watchdog.
+			go func() {
+				<-ctx.Done()
+				if watchdog.Reason() != "" {
+					audited.Exit(exitCodeTimeout)
+					sess.Exit(exitCodeTimeout)
+				}
+			}()
+
+			server := sftp.NewServer(sftp.NewExecFileSystem(runner))
+
+			err := server.Serve(struct {
+				io.Reader
+				io.Writer
+			}{opts.Stdin, opts.Stdout})
+			if watchdog.Reason() != "" {
+				return
+			}
+
+			if err != nil {
+				logger.Print(fmt.Sprintf("Failed to serve sftp for %s: %s", user, err.Error()))
+				audited.Fail(err)
+				exitWithError(sess, err)
+				return
+			}
+
+			audited.Exit(0)
+			sess.Exit(0)
+			return
+		}
+
+		if cmd.TTY && shared != nil {
+			// Shared sessions are sized to fit the smallest client.
+			opts.TerminalSizeQueue = newSizeQueue(ctx, shared.Window(), shared.Windows())
+		} else if cmd.TTY && resumable != nil {
+			opts.TerminalSizeQueue = newSizeQueue(ctx, resumable.Window(), resumable.Windows())
+		} else if cmd.TTY {
+			sizeQueue := NewResizeQueue(ctx, sess)
+			opts.TerminalSizeQueue = sizeQueue
+		}
+
+		if recorder != nil && opts.TerminalSizeQueue != nil {
+			opts.TerminalSizeQueue = NewRecordingSizeQueue(opts.TerminalSizeQueue, recorder)
+		}
+
+		exec, err := executor(ctx, cmd)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to run command '%s' as %s: %s", strings.Join(cmd.Command, " "), user, err.Error()))
+			audited.Fail(err)
+			exitWithError(sess, err)
 			return
 		}
 
 		logger.Print(fmt.Sprintf("Executing command '%s'", strings.Join(cmd.Command, " ")))
 
 		err = exec.Stream(opts)
-		if err != nil {
-			logger.Print(fmt.Sprintf("Failed to stream command '%s' as %s: %s", strings.Join(cmd.Command, " "), user, err.Error()))
 
-			// Return the error code output to the end user so they can see why the request failed.
-			io.WriteString(sess, err.Error())
+		// The session was closed while the command was running, clean up anything it left behind.
+		if ctx.Err() != nil || watchdog.Reason() != "" {
+			if watchdog.Reason() == "" {
+				logger.Print(fmt.Sprintf("Client disconnected while running command '%s'", strings.Join(cmd.Command, " ")))
+			}
+
+			if *cliKillOrphans {
+				err := runCommand(config, crdclient.URL(pod, container, &v1.PodExecOptions{
+					Stdout:  true,
+					Stderr:  true,
+					Command: orphanKillCommand(pidFile),
+				}))
+				if err != nil {
+					logger.Print(fmt.Sprintf("Failed to kill orphaned processes for command '%s': %s", strings.Join(cmd.Command, " "), err.Error()))
+				}
+			}
 
-			// This will send an error code back to the SSH client.
-			sess.Exit(1)
+			if watchdog.Reason() != "" {
+				audited.Exit(exitCodeTimeout)
+				finish(func(client ssh.Session) {
+					client.Exit(exitCodeTimeout)
+				})
+			}
 
 			return
 		}
-	})
 
-	publicKeyHandler := ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
-		namespace, _, _, user, err := splitUser(ctx.User())
+		// The pid file is only needed while the command is running.
+		if *cliKillOrphans {
+			defer func() {
+				go runCommand(config, crdclient.URL(pod, container, &v1.PodExecOptions{
+					Stdout:  true,
+					Stderr:  true,
+					Command: []string{"rm", "-f", pidFile},
+				}))
+			}()
+		}
+
+		code, remote := exitStatus(err)
+		if !remote {
+			logger.Print(fmt.Sprintf("Failed to stream command '%s' as %s: %s", strings.Join(cmd.Command, " "), user, err.Error()))
+			audited.Fail(err)
+			finish(func(client ssh.Session) {
+				exitWithError(client, err)
+			})
+			return
+		}
+
+		logger.Print(fmt.Sprintf("Command '%s' exited with status %d", strings.Join(cmd.Command, " "), code))
+
+		audited.Exit(code)
+		finish(func(client ssh.Session) {
+			exitWithStatus(client, code)
+		})
+	}
+
+	ssh.Handle(handler)
+
+	srv.SubsystemHandlers = map[string]ssh.SubsystemHandler{
+		subsystemSFTP: handler,
+	}
+
+	srv.ChannelHandlers = map[string]ssh.ChannelHandler{
+		"session":      ssh.DefaultSessionHandler,
+		"direct-tcpip": forwarder.DirectTCPIPHandler(router),
+	}
+
+	srv.RequestHandlers = reverse.Handlers(router)
+
+	authenticate := func(ctx ssh.Context, key ssh.PublicKey) (bool, string) {
+		// Users resuming a session must be the user who started it.
+		if token, user, ok := parseResumeUsername(ctx.User()); ok {
+			resumable, ok := resumables.Get(token)
+			if !ok || resumable.User != user {
+				return false, authReasonSessionNotFound
+			}
+
+			return authResult(authorizer.Authorized(resumable.Namespace, user, key))
+		}
+
+		// Users joining a shared session must be allowed in the namespace it is running in.
+		if id, user, _, ok := parseJoinUsername(ctx.User()); ok {
+			shared, ok := hub.Get(id)
+			if !ok {
+				return false, authReasonSessionNotFound
+			}
+
+			return authResult(authorizer.Authorized(shared.Namespace, user, key))
+		}
+
+		namespace, user, err := router.Identity(ctx.User())
 		if err != nil {
 			promlog.Info("Failed to get namespace, pod and container from user:", err)
-			return false
+			return false, authReasonInvalidUsername
 		}
 
-		crdclient := client.Client(crdcs, scheme, namespace)
+		// The namespace will be chosen once the session starts, so allow any namespace the key is valid for.
+		if namespace == "" {
+			namespaces, err := authorizer.Namespaces(user, key)
+			return authResult(len(namespaces) > 0, err)
+		}
 
-		sshUser, err := crdclient.Get(user)
-		if err != nil {
-			promlog.Info("Failed to load the user objects:", err)
-			return false
+		return authResult(authorizer.Authorized(namespace, user, key))
+	}
+
+	publicKeyHandler := ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
+		event := audit.Event{
+			Type:        audit.TypeAuthAttempt,
+			User:        ctx.User(),
+			Fingerprint: fingerprint(key),
+			RemoteAddr:  ctx.RemoteAddr().String(),
 		}
+		auditor.Emit(event)
 
-		for _, authorizedKey := range sshUser.Spec.AuthorizedKeys {
-			allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
-			if err != nil {
-				promlog.Info("Failed to parse key:", err)
-				return false
-			}
+		allowed, reason := authenticate(ctx, key)
 
-			if ssh.KeysEqual(key, allowed) {
-				return true
-			}
+		result := "accepted"
+		if !allowed {
+			result = "rejected"
 		}
 
-		return false
+		metricAuthAttempts.WithLabelValues(result, reason).Inc()
+
+		event.Type = audit.TypeAuthResult
+		event.Success = audit.Bool(allowed)
+		event.Reason = reason
+		auditor.Emit(event)
+
+		return allowed
 	})
 	srv.SetOption(publicKeyHandler)
 
-	// Check if a signer was provided, if one was, load it and add to the server.
-	if *cliSigner != "" {
-		signer, err := getSigner(*cliSigner)
-		if err != nil {
-			panic(err)
-		}
-
+	if signer != nil {
 		srv.HostSigners = append(srv.HostSigners, signer)
 	}
 
-	err = srv.ListenAndServe()
+	srv.ConnCallback = trackConnection
+
+	promlog.Info("Waiting for the user cache to sync")
+
+	if !cache.WaitForCacheSync(stop, authorizer.HasSynced) {
+		promlog.Fatal("Failed to sync the user cache")
+	}
+
+	listener, err := net.Listen("tcp", *cliListen)
 	if err != nil {
-		panic(err)
+		promlog.Fatalf("Failed to listen on %s: %s", *cliListen, err)
 	}
+
+	listening()
+
+	done := shutdownOnSignal(srv, ready, drainer, *cliShutdown)
+
+	err = srv.Serve(listener)
+	if err != nil && err != ssh.ErrServerClosed {
+		promlog.Fatalf("Failed to serve SSH: %s", err)
+	}
+
+	<-done
+
+	// Flushes audit events which have not been sent yet, and signs a final checkpoint.
+	if err := auditor.Close(); err != nil {
+		promlog.Info("Failed to close the audit log:", err)
+	}
+
+	promlog.Info("SSH Server stopped")
 }
 
 // Helper function to generate a signer certificate if one does not exist.
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Helper function to ask the user to pick from a list of choices on their terminal.
+// Choices can be selected by number or by name.
+func promptChoice(sess ssh.Session, title string, choices []string) (string, error) {
+	term := terminal.NewTerminal(sess, "")
+
+	fmt.Fprintf(term, "%s\n", title)
+
+	for i, choice := range choices {
+		fmt.Fprintf(term, "  %d) %s\n", i+1, choice)
+	}
+
+	term.SetPrompt(fmt.Sprintf("Select [1-%d]: ", len(choices)))
+
+	for {
+		line, err := term.ReadLine()
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n > 0 && n <= len(choices) {
+			return choices[n-1], nil
+		}
+
+		for _, choice := range choices {
+			if choice == line {
+				return choice, nil
+			}
+		}
+
+		fmt.Fprintf(term, "Invalid choice: %s\n", line)
+	}
+}
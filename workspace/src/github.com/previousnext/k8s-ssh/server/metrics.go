@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prefix of the gateway's metrics.
+const metricsNamespace = "k8s_ssh"
+
+// Types of sessions, used to label their metrics.
+const (
+	sessionTypeShell   = "shell"
+	sessionTypeExec    = "exec"
+	sessionTypeRsync   = "rsync"
+	sessionTypeScp     = "scp"
+	sessionTypeSftp    = "sftp"
+	sessionTypeForward = "forward"
+)
+
+var (
+	metricConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_total",
+		Help:      "SSH connections accepted by the gateway.",
+	})
+
+	metricActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_connections",
+		Help:      "SSH connections which are currently open.",
+	})
+
+	metricAuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_attempts_total",
+		Help:      "Public key authentication attempts by result and reason.",
+	}, []string{"result", "reason"})
+
+	metricActiveSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_sessions",
+		Help:      "Sessions and port forwards which are currently open, by namespace and type.",
+	}, []string{"namespace", "type"})
+
+	metricExecSetup = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "exec_setup_seconds",
+		Help:      "Time taken for the API server to open a stream to a container, for commands and port forwards.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes sent by clients (in) and to clients (out), by type of session.",
+	}, []string{"type", "direction"})
+
+	metricSessionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "session_duration_seconds",
+		Help:      "How long sessions and port forwards were open, by type.",
+		// From a second to a few days.
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricConnections,
+		metricActiveConnections,
+		metricAuthAttempts,
+		metricActiveSessions,
+		metricExecSetup,
+		metricBytes,
+		metricSessionDuration,
+	)
+}
+
+// Helper function to count a session as active until the returned function is called, which
+// records how long it was open and the bytes sent each way.
+func trackSession(namespace, kind string) func(in, out int64) {
+	active := metricActiveSessions.WithLabelValues(namespace, kind)
+	active.Inc()
+
+	start := time.Now()
+
+	return func(in, out int64) {
+		active.Dec()
+		metricSessionDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		metricBytes.WithLabelValues(kind, "in").Add(float64(in))
+		metricBytes.WithLabelValues(kind, "out").Add(float64(out))
+	}
+}
+
+// Helper function to count connections to the server, for the ConnCallback of the server.
+func trackConnection(ctx ssh.Context, conn net.Conn) net.Conn {
+	metricConnections.Inc()
+	metricActiveConnections.Inc()
+
+	return &trackedConn{
+		Conn: conn,
+	}
+}
+
+// A connection which is no longer counted as active once it is closed.
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(metricActiveConnections.Dec)
+	return c.Conn.Close()
+}
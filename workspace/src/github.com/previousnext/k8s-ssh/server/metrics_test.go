@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to read the value of a gauge or counter.
+func metricValue(t *testing.T, metric prometheus.Metric) float64 {
+	var m dto.Metric
+	assert.Nil(t, metric.Write(&m))
+
+	if m.Gauge != nil {
+		return m.Gauge.GetValue()
+	}
+
+	return m.Counter.GetValue()
+}
+
+func TestTrackSession(t *testing.T) {
+	untrack := trackSession("dev", sessionTypeShell)
+	assert.Equal(t, float64(1), metricValue(t, metricActiveSessions.WithLabelValues("dev", sessionTypeShell)))
+
+	untrack(10, 200)
+	assert.Equal(t, float64(0), metricValue(t, metricActiveSessions.WithLabelValues("dev", sessionTypeShell)))
+	assert.Equal(t, float64(10), metricValue(t, metricBytes.WithLabelValues(sessionTypeShell, "in")))
+	assert.Equal(t, float64(200), metricValue(t, metricBytes.WithLabelValues(sessionTypeShell, "out")))
+}
+
+func TestTrackConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := trackConnection(nil, server)
+	assert.Equal(t, float64(1), metricValue(t, metricConnections))
+	assert.Equal(t, float64(1), metricValue(t, metricActiveConnections))
+
+	// Connections are only counted as closed once.
+	conn.Close()
+	conn.Close()
+	assert.Equal(t, float64(0), metricValue(t, metricActiveConnections))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Strategies for picking a pod when a workload has more than one Ready pod.
+const (
+	podStrategyRandom   = "random"
+	podStrategyOldest   = "oldest"
+	podStrategySessions = "sessions"
+)
+
+// PodResolver resolves the pod segment of a username to a Ready pod.
+type PodResolver struct {
+	clientset kubernetes.Interface
+	strategy  string
+	sessions  *SessionCounter
+}
+
+// NewPodResolver returns a resolver which picks pods using the given strategy.
+func NewPodResolver(clientset kubernetes.Interface, strategy string, sessions *SessionCounter) *PodResolver {
+	return &PodResolver{
+		clientset: clientset,
+		strategy:  strategy,
+		sessions:  sessions,
+	}
+}
+
+// Resolve returns the name of a Ready pod for the target within the namespace.
+// Lookups never leave the namespace, so users cannot target pods they are not allowed to.
+func (r *PodResolver) Resolve(namespace, target string) (string, error) {
+	kind, name, err := splitPodTarget(target)
+	if err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case podKindPod:
+		// Pods which are addressed directly are passed through so the API server can report any problems.
+		return name, nil
+
+	case podKindDeployment:
+		deployment, err := r.clientset.AppsV1beta1().Deployments(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		return r.resolveLabelSelector(namespace, target, deployment.Spec.Selector)
+
+	case podKindStatefulSet:
+		set, err := r.clientset.AppsV1beta1().StatefulSets(namespace).Get(name, meta_v1.GetOptions{})
+		if err == nil {
+			return r.resolveLabelSelector(namespace, target, set.Spec.Selector)
+		}
+
+		// Allow a single replica to be targeted by its ordinal eg. "sts/db-0".
+		setName, ok := splitOrdinal(name)
+		if !apierrors.IsNotFound(err) || !ok {
+			return "", err
+		}
+
+		_, err = r.clientset.AppsV1beta1().StatefulSets(namespace).Get(setName, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		pod, err := r.clientset.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		if !isPodReady(*pod) {
+			return "", fmt.Errorf("pod is not ready: %s", name)
+		}
+
+		return pod.Name, nil
+
+	case podKindDaemonSet:
+		set, err := r.clientset.ExtensionsV1beta1().DaemonSets(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		return r.resolveLabelSelector(namespace, target, set.Spec.Selector)
+
+	case podKindService:
+		service, err := r.clientset.CoreV1().Services(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		if len(service.Spec.Selector) == 0 {
+			return "", fmt.Errorf("service does not have a selector: %s", name)
+		}
+
+		return r.resolveSelector(namespace, target, labels.SelectorFromSet(service.Spec.Selector))
+
+	case podKindSelector:
+		selector, err := labels.Parse(name)
+		if err != nil {
+			return "", err
+		}
+
+		return r.resolveSelector(namespace, target, selector)
+	}
+
+	return "", fmt.Errorf("unsupported pod target: %s", target)
+}
+
+// List returns the names of the Ready pods in the namespace.
+func (r *PodResolver) List(namespace string) ([]string, error) {
+	var names []string
+
+	list, err := r.clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{})
+	if err != nil {
+		return names, err
+	}
+
+	for _, pod := range list.Items {
+		if isPodReady(pod) {
+			names = append(names, pod.Name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Helper function to resolve a workload's label selector to a pod.
+func (r *PodResolver) resolveLabelSelector(namespace, target string, ls *meta_v1.LabelSelector) (string, error) {
+	if ls == nil {
+		return "", fmt.Errorf("workload does not have a selector: %s", target)
+	}
+
+	selector, err := meta_v1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		return "", err
+	}
+
+	return r.resolveSelector(namespace, target, selector)
+}
+
+// Helper function to pick a Ready pod which matches a selector.
+func (r *PodResolver) resolveSelector(namespace, target string, selector labels.Selector) (string, error) {
+	// An empty selector would match every pod in the namespace.
+	if selector.Empty() {
+		return "", fmt.Errorf("refusing to use an empty selector for: %s", target)
+	}
+
+	list, err := r.clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var ready []v1.Pod
+
+	for _, pod := range list.Items {
+		if isPodReady(pod) {
+			ready = append(ready, pod)
+		}
+	}
+
+	if len(ready) == 0 {
+		return "", fmt.Errorf("no ready pods found for: %s", target)
+	}
+
+	return r.pick(namespace, ready).Name, nil
+}
+
+// Helper function to pick one pod from a list of candidates using the configured strategy.
+func (r *PodResolver) pick(namespace string, pods []v1.Pod) v1.Pod {
+	switch r.strategy {
+	case podStrategyOldest:
+		sort.SliceStable(pods, func(i, j int) bool {
+			return pods[i].CreationTimestamp.Before(pods[j].CreationTimestamp)
+		})
+
+		return pods[0]
+
+	case podStrategySessions:
+		// Shuffle first so pods with the same number of sessions share the load.
+		shuffled := make([]v1.Pod, len(pods))
+		for i, j := range rand.Perm(len(pods)) {
+			shuffled[i] = pods[j]
+		}
+		pods = shuffled
+
+		sort.SliceStable(pods, func(i, j int) bool {
+			return r.sessions.Count(namespace, pods[i].Name) < r.sessions.Count(namespace, pods[j].Name)
+		})
+
+		return pods[0]
+	}
+
+	return pods[rand.Intn(len(pods))]
+}
+
+// Helper function to determine if a pod is running and passing its readiness checks.
+func isPodReady(pod v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// SessionCounter keeps track of the number of active sessions for each pod.
+type SessionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewSessionCounter returns an empty session counter.
+func NewSessionCounter() *SessionCounter {
+	return &SessionCounter{
+		counts: make(map[string]int),
+	}
+}
+
+// Add records a new session for a pod. The returned function must be called when the session ends.
+func (c *SessionCounter) Add(namespace, pod string) func() {
+	key := namespace + "/" + pod
+
+	c.mu.Lock()
+	c.counts[key]++
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.counts[key]--
+		if c.counts[key] <= 0 {
+			delete(c.counts, key)
+		}
+	}
+}
+
+// Count returns the number of active sessions for a pod.
+func (c *SessionCounter) Count(namespace, pod string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[namespace+"/"+pod]
+}
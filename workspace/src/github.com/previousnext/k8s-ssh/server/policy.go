@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations which can be set on a namespace to override the server defaults.
+const (
+	annotationIdleTimeout = "ssh.skpr.io/idle-timeout"
+	annotationMaxDuration = "ssh.skpr.io/max-duration"
+
+	annotationReverseForwarding = "ssh.skpr.io/reverse-forwarding"
+	annotationAgentForwarding   = "ssh.skpr.io/agent-forwarding"
+	annotationRecord            = "ssh.skpr.io/record"
+)
+
+// Policy holds the settings which apply to sessions in a namespace.
+type Policy struct {
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+
+	// Allows clients to expose ports inside the namespace with "ssh -R".
+	ReverseForwarding bool
+
+	// Allows clients to forward their agent into containers with "ssh -A".
+	AgentForwarding bool
+
+	// Records sessions with a terminal in the asciicast format.
+	Record bool
+}
+
+// PolicyLoader loads the policy for a namespace, falling back to the server defaults.
+type PolicyLoader struct {
+	clientset kubernetes.Interface
+	defaults  Policy
+}
+
+// NewPolicyLoader returns a loader which uses the defaults for settings a namespace does not override.
+func NewPolicyLoader(clientset kubernetes.Interface, defaults Policy) *PolicyLoader {
+	return &PolicyLoader{
+		clientset: clientset,
+		defaults:  defaults,
+	}
+}
+
+// Load returns the policy for the namespace.
+func (l *PolicyLoader) Load(namespace string) (Policy, error) {
+	ns, err := l.clientset.CoreV1().Namespaces().Get(namespace, meta_v1.GetOptions{})
+	if err != nil {
+		return l.defaults, err
+	}
+
+	return applyAnnotations(l.defaults, ns.Annotations)
+}
+
+// Helper function to override a policy with the annotations from a namespace. Each annotation is
+// applied on its own, so an invalid value does not stop the others from being applied.
+func applyAnnotations(policy Policy, annotations map[string]string) (Policy, error) {
+	var invalid []string
+
+	durations := map[string]*time.Duration{
+		annotationIdleTimeout: &policy.IdleTimeout,
+		annotationMaxDuration: &policy.MaxDuration,
+	}
+
+	for annotation, target := range durations {
+		value, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", annotation, err))
+			continue
+		}
+
+		*target = d
+	}
+
+	switches := map[string]*bool{
+		annotationReverseForwarding: &policy.ReverseForwarding,
+		annotationAgentForwarding:   &policy.AgentForwarding,
+		annotationRecord:            &policy.Record,
+	}
+
+	for annotation, target := range switches {
+		value, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %s", annotation, err))
+			continue
+		}
+
+		*target = b
+	}
+
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return policy, fmt.Errorf("invalid value for annotations %s", strings.Join(invalid, ", "))
+	}
+
+	return policy, nil
+}
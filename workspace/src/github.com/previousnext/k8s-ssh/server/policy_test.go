@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyAnnotations(t *testing.T) {
+	defaults := Policy{
+		IdleTimeout:       time.Hour,
+		ReverseForwarding: true,
+	}
+
+	policy, err := applyAnnotations(defaults, map[string]string{
+		annotationIdleTimeout:       "10m",
+		annotationReverseForwarding: "false",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Policy{IdleTimeout: 10 * time.Minute}, policy)
+
+	// An invalid annotation does not stop the others from being applied.
+	policy, err = applyAnnotations(defaults, map[string]string{
+		annotationIdleTimeout: "forever",
+		annotationMaxDuration: "8h",
+		annotationRecord:      "true",
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), annotationIdleTimeout)
+	assert.Equal(t, Policy{IdleTimeout: time.Hour, MaxDuration: 8 * time.Hour, ReverseForwarding: true, Record: true}, policy)
+}
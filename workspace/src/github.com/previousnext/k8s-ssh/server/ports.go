@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Group which matches every user in a port policy.
+const portPolicyAnyGroup = "*"
+
+// PortPolicy holds the ports each group of users is allowed to forward to.
+type PortPolicy map[string][]portRange
+
+// An inclusive range of ports.
+type portRange struct {
+	from, to int
+}
+
+// Helper function to parse a port policy eg. "dev=5432,6379,8000-8080 admin=*".
+// Groups are separated by spaces, "*" can be used for all ports or for all groups.
+func parsePortPolicy(value string) (PortPolicy, error) {
+	policy := make(PortPolicy)
+
+	for _, entry := range strings.Fields(value) {
+		sl := strings.SplitN(entry, "=", 2)
+		if len(sl) != 2 || sl[0] == "" {
+			return nil, fmt.Errorf("invalid port policy: %s", entry)
+		}
+
+		group := sl[0]
+
+		for _, ports := range strings.Split(sl[1], ",") {
+			r, err := parsePortRange(ports)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port policy for group %s: %s", group, err)
+			}
+
+			policy[group] = append(policy[group], r)
+		}
+	}
+
+	return policy, nil
+}
+
+// Helper function to parse a port eg. "5432", a range eg. "8000-8080" or all ports eg. "*".
+func parsePortRange(value string) (portRange, error) {
+	if value == "*" {
+		return portRange{1, 65535}, nil
+	}
+
+	sl := strings.SplitN(value, "-", 2)
+
+	from, err := parsePort(sl[0])
+	if err != nil {
+		return portRange{}, err
+	}
+
+	if len(sl) == 1 {
+		return portRange{from, from}, nil
+	}
+
+	to, err := parsePort(sl[1])
+	if err != nil {
+		return portRange{}, err
+	}
+
+	if to < from {
+		return portRange{}, fmt.Errorf("invalid port range: %s", value)
+	}
+
+	return portRange{from, to}, nil
+}
+
+// Helper function to parse a port number.
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", value)
+	}
+
+	return port, nil
+}
+
+// Allowed returns true if one of the groups may forward to the port.
+func (p PortPolicy) Allowed(groups []string, port int) bool {
+	for _, group := range append([]string{portPolicyAnyGroup}, groups...) {
+		for _, r := range p[group] {
+			if port >= r.from && port <= r.to {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortPolicy(t *testing.T) {
+	policy, err := parsePortPolicy("dev=5432,8000-8080 admin=* *=80")
+	assert.Nil(t, err)
+
+	assert.True(t, policy.Allowed([]string{"dev"}, 5432))
+	assert.True(t, policy.Allowed([]string{"dev"}, 8080))
+	assert.False(t, policy.Allowed([]string{"dev"}, 8081))
+	assert.True(t, policy.Allowed([]string{"ops", "admin"}, 22))
+	assert.True(t, policy.Allowed([]string{}, 80))
+	assert.False(t, policy.Allowed([]string{}, 443))
+
+	policy, err = parsePortPolicy("")
+	assert.Nil(t, err)
+	assert.False(t, policy.Allowed([]string{"dev"}, 5432))
+
+	for _, invalid := range []string{"dev", "=80", "dev=0", "dev=80-70", "dev=http", "dev=1-65536"} {
+		_, err = parsePortPolicy(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
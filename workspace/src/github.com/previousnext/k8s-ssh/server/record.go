@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	promlog "github.com/prometheus/common/log"
+	"k8s.io/client-go/tools/remotecommand"
+
+	"github.com/previousnext/k8s-ssh/recording"
+)
+
+// Storage backends for session recordings, which can be selected with the --record-storage flag.
+const (
+	recordStorageLocal  = "local"
+	recordStorageVolume = "volume"
+	recordStorageS3     = "s3"
+)
+
+// How often recordings older than the retention period are removed.
+const recordPruneInterval = time.Hour
+
+// Helper function to start recording a session, grouped by namespace eg.
+// "<namespace>/20060102T150405Z-<session id>.cast".
+func startRecording(storage recording.Storage, header recording.Header) (*recording.Recorder, string, error) {
+	name := fmt.Sprintf("%s/%s-%s%s", header.Session.Namespace, time.Now().UTC().Format("20060102T150405Z"), header.Session.ID, recording.Extension)
+
+	w, err := storage.Create(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	recorder, err := recording.New(w, header)
+	if err != nil {
+		w.Close()
+		return nil, "", err
+	}
+
+	return recorder, name, nil
+}
+
+// Helper function to remove recordings which are older than the retention period, until the
+// server exits.
+func pruneRecordings(storage recording.Storage, retention time.Duration) {
+	for {
+		removed, err := storage.Prune(time.Now().Add(-retention))
+		if err != nil {
+			promlog.Info("Failed to remove old recordings:", err)
+		} else if removed > 0 {
+			promlog.Info("Removed old recordings:", removed)
+		}
+
+		time.Sleep(recordPruneInterval)
+	}
+}
+
+// RecordingSizeQueue records each window size before it is sent to the container.
+type RecordingSizeQueue struct {
+	queue    remotecommand.TerminalSizeQueue
+	recorder *recording.Recorder
+}
+
+// NewRecordingSizeQueue returns a queue which records the sizes from another queue.
+func NewRecordingSizeQueue(queue remotecommand.TerminalSizeQueue, recorder *recording.Recorder) *RecordingSizeQueue {
+	return &RecordingSizeQueue{
+		queue:    queue,
+		recorder: recorder,
+	}
+}
+
+// Next returns the next window resize event.
+func (q *RecordingSizeQueue) Next() *remotecommand.TerminalSize {
+	size := q.queue.Next()
+	if size != nil {
+		q.recorder.Resize(int(size.Width), int(size.Height))
+	}
+
+	return size
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"github.com/gliderlabs/ssh"
 	"k8s.io/client-go/tools/remotecommand"
 )
@@ -11,17 +13,35 @@ type SizeQueue struct {
 }
 
 // NewResizeQueue returns a size queue for storing window resize events.
-func NewResizeQueue(sess ssh.Session) *SizeQueue {
+// The queue is closed when the context is cancelled or the session ends.
+func NewResizeQueue(ctx context.Context, sess ssh.Session) *SizeQueue {
+	pty, winCh, _ := sess.Pty()
+	return newSizeQueue(ctx, pty.Window, winCh)
+}
+
+// Helper function to create a size queue which starts with the initial window size and then
+// follows the window change events. Events which have not been read yet are replaced by newer
+// ones, so a burst of events while the user drags their window only results in the latest size.
+func newSizeQueue(ctx context.Context, initial ssh.Window, winCh <-chan ssh.Window) *SizeQueue {
 	queue := &SizeQueue{
 		resizeChan: make(chan remotecommand.TerminalSize, 1),
 	}
 
-	_, winCh, _ := sess.Pty()
+	queue.push(initial)
+
 	go func() {
-		for win := range winCh {
-			queue.resizeChan <- remotecommand.TerminalSize{
-				Height: uint16(win.Height),
-				Width:  uint16(win.Width),
+		defer close(queue.resizeChan)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case win, ok := <-winCh:
+				if !ok {
+					return
+				}
+
+				queue.push(win)
 			}
 		}
 	}()
@@ -29,6 +49,32 @@ func NewResizeQueue(sess ssh.Session) *SizeQueue {
 	return queue
 }
 
+// Helper function to queue a window size, replacing any size which has not been read yet.
+func (s *SizeQueue) push(win ssh.Window) {
+	// Windows without a size eg. a client which did not send one, would hide the terminal.
+	if win.Width <= 0 || win.Height <= 0 {
+		return
+	}
+
+	size := remotecommand.TerminalSize{
+		Height: uint16(win.Height),
+		Width:  uint16(win.Width),
+	}
+
+	for {
+		select {
+		case s.resizeChan <- size:
+			return
+		default:
+		}
+
+		select {
+		case <-s.resizeChan:
+		default:
+		}
+	}
+}
+
 // Next returns the next window resize event.
 func (s *SizeQueue) Next() *remotecommand.TerminalSize {
 	size, ok := <-s.resizeChan
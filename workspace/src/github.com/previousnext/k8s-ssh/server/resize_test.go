@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestSizeQueueInitial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := newSizeQueue(ctx, ssh.Window{Width: 120, Height: 40}, make(chan ssh.Window))
+	assert.Equal(t, &remotecommand.TerminalSize{Width: 120, Height: 40}, queue.Next())
+}
+
+func TestSizeQueueCoalesce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	winCh := make(chan ssh.Window)
+
+	queue := newSizeQueue(ctx, ssh.Window{Width: 80, Height: 24}, winCh)
+
+	// The unbuffered channel makes sure each event has been received before sending the next.
+	for i := 1; i <= 10; i++ {
+		winCh <- ssh.Window{Width: 80 + i, Height: 24 + i}
+	}
+
+	close(winCh)
+
+	var sizes []*remotecommand.TerminalSize
+
+	for size := queue.Next(); size != nil; size = queue.Next() {
+		sizes = append(sizes, size)
+	}
+
+	// Only the latest size needs to be delivered, although the final event can race with the read.
+	assert.True(t, len(sizes) > 0 && len(sizes) <= 2)
+	assert.Equal(t, &remotecommand.TerminalSize{Width: 90, Height: 34}, sizes[len(sizes)-1])
+}
+
+func TestSizeQueueCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	queue := newSizeQueue(ctx, ssh.Window{}, make(chan ssh.Window))
+
+	cancel()
+
+	assert.Nil(t, queue.Next())
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Username used to reattach to a session eg. "resume+<token>+<user>".
+const resumePrefix = "resume"
+
+// How many writes are queued for a client before it is dropped for not keeping up.
+const resumeOutputQueue = 1024
+
+// How long to wait for the attached client to receive the rest of the output and the exit
+// status once the command exits.
+const resumeExitTimeout = 5 * time.Second
+
+// Helper function to parse a username used to reattach to a session, returning false if it is not one.
+func parseResumeUsername(username string) (token, user string, ok bool) {
+	sl := strings.Split(username, joinSeparator)
+	if len(sl) != 3 || sl[0] != resumePrefix || sl[1] == "" || sl[2] == "" {
+		return "", "", false
+	}
+
+	return sl[1], sl[2], true
+}
+
+// Helper function to generate a token which is hard to guess, used to reattach to a session.
+func resumeToken() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// ResumableSessions holds the sessions which can be reattached to on this gateway, by token.
+type ResumableSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*ResumableSession
+}
+
+// NewResumableSessions returns an empty set of sessions.
+func NewResumableSessions() *ResumableSessions {
+	return &ResumableSessions{
+		sessions: make(map[string]*ResumableSession),
+	}
+}
+
+// Add allows the session to be reattached to with its token.
+func (r *ResumableSessions) Add(s *ResumableSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[s.Token] = s
+}
+
+// Remove stops the session being reattached to.
+func (r *ResumableSessions) Remove(s *ResumableSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, s.Token)
+}
+
+// Get returns the session for a token.
+func (r *ResumableSessions) Get(token string) (*ResumableSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[token]
+	return s, ok
+}
+
+// ResumableSession keeps a command running when the client disconnects, buffering its output
+// until the client reattaches or the grace period ends.
+type ResumableSession struct {
+	ID        string
+	Token     string
+	Namespace string
+	User      string
+
+	grace  time.Duration
+	expire func()
+
+	stdin *io.PipeReader
+	input *io.PipeWriter
+
+	mu       sync.Mutex
+	buffer   *outputBuffer
+	client   *resumeAttachment
+	timer    *time.Timer
+	window   ssh.Window
+	windows  chan ssh.Window
+	finished bool
+}
+
+// A client attached to a resumable session, output is queued and written to it by its own
+// goroutine so a slow client never holds up the command.
+type resumeAttachment struct {
+	sess     ssh.Session
+	output   chan []byte
+	detached chan struct{}
+	released chan error
+	exit     func(ssh.Session)
+	dropped  bool
+}
+
+// NewResumableSession returns a session which calls expire if no client is attached for the
+// grace period, keeping the last size bytes of output for clients who reattach.
+func NewResumableSession(id, token, namespace, user string, grace time.Duration, size int, expire func()) *ResumableSession {
+	r, w := io.Pipe()
+
+	return &ResumableSession{
+		ID:        id,
+		Token:     token,
+		Namespace: namespace,
+		User:      user,
+		grace:     grace,
+		expire:    expire,
+		stdin:     r,
+		input:     w,
+		buffer:    newOutputBuffer(size),
+		windows:   make(chan ssh.Window, 1),
+	}
+}
+
+// Stdin returns the input from the attached client.
+func (s *ResumableSession) Stdin() io.Reader {
+	return s.stdin
+}
+
+// Write buffers the output and queues it for the attached client. It never fails, output
+// written while no client is attached is kept in the buffer. A client which cannot keep up
+// is dropped and the grace period starts, so it can reattach.
+func (s *ResumableSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buffer.Write(p)
+
+	if s.client != nil {
+		data := make([]byte, len(p))
+		copy(data, p)
+
+		select {
+		case s.client.output <- data:
+		default:
+			s.client.dropped = true
+			s.release()
+			s.timer = time.AfterFunc(s.grace, s.expire)
+		}
+	}
+
+	return len(p), nil
+}
+
+// Window returns the size of the attached client's window.
+func (s *ResumableSession) Window() ssh.Window {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.window
+}
+
+// Windows returns the size of the window whenever the client resizes or reattaches.
+func (s *ResumableSession) Windows() <-chan ssh.Window {
+	return s.windows
+}
+
+// Attach connects a client to the session, replacing any client which is already attached.
+// If replay is true, the buffered output is sent to the client first. The returned channel is
+// closed once the client has been sent its output and it disconnects, is replaced or the
+// session finishes. ErrTooSlow is sent first if the client was dropped for not keeping up.
+func (s *ResumableSession) Attach(sess ssh.Session, replay bool) <-chan error {
+	pty, winCh, _ := sess.Pty()
+
+	client := &resumeAttachment{
+		sess:     sess,
+		output:   make(chan []byte, resumeOutputQueue),
+		detached: make(chan struct{}),
+		released: make(chan error, 1),
+	}
+	released := client.released
+
+	s.mu.Lock()
+
+	if s.finished {
+		s.mu.Unlock()
+		close(released)
+		return released
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if s.client != nil {
+		s.release()
+	}
+
+	if replay {
+		data := make([]byte, len(s.buffer.Bytes()))
+		copy(data, s.buffer.Bytes())
+		client.output <- data
+	}
+
+	s.client = client
+	s.window = pty.Window
+
+	s.mu.Unlock()
+
+	go s.send(client)
+
+	sendWindow(s.windows, pty.Window)
+
+	// Input is only accepted from the attached client.
+	go func() {
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := sess.Read(buf)
+
+			if n > 0 && s.attached(sess) {
+				if _, err := s.input.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+
+			if err != nil {
+				s.detach(sess)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-client.detached:
+				return
+
+			case <-sess.Context().Done():
+				s.detach(sess)
+				return
+
+			case win, ok := <-winCh:
+				if !ok {
+					return
+				}
+
+				s.mu.Lock()
+				current := s.client == client
+				if current {
+					s.window = win
+				}
+				s.mu.Unlock()
+
+				if current {
+					sendWindow(s.windows, win)
+				}
+			}
+		}
+	}()
+
+	return released
+}
+
+// Finish is called once the command has exited, with a function which sends the exit status to
+// the client which is attached, if there is one, and releases the client. It waits a short time
+// for the client to receive the rest of the output. It is safe to call more than once.
+func (s *ResumableSession) Finish(exit func(ssh.Session)) {
+	s.mu.Lock()
+
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+
+	s.finished = true
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	client := s.client
+	if client != nil {
+		client.exit = exit
+		s.release()
+	}
+
+	s.mu.Unlock()
+
+	s.input.Close()
+
+	if client != nil {
+		select {
+		case <-client.released:
+		case <-time.After(resumeExitTimeout):
+		}
+	}
+}
+
+// Finished returns true once the command has exited.
+func (s *ResumableSession) Finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.finished
+}
+
+// Helper function to check if the client is attached.
+func (s *ResumableSession) attached(sess ssh.Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client != nil && s.client.sess == sess
+}
+
+// Helper function to detach a client which disconnected, starting the grace period.
+func (s *ResumableSession) detach(sess ssh.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil || s.client.sess != sess || s.finished {
+		return
+	}
+
+	s.release()
+	s.timer = time.AfterFunc(s.grace, s.expire)
+}
+
+// Helper function to stop queueing output for the attached client, its goroutine sends what
+// is already queued and then releases it. The lock must be held.
+func (s *ResumableSession) release() {
+	close(s.client.output)
+	close(s.client.detached)
+	s.client = nil
+}
+
+// Helper function to write the queued output to a client, until it is released.
+func (s *ResumableSession) send(client *resumeAttachment) {
+	for data := range client.output {
+		client.sess.Write(data)
+	}
+
+	s.mu.Lock()
+	exit, dropped := client.exit, client.dropped
+	s.mu.Unlock()
+
+	if exit != nil {
+		exit(client.sess)
+	}
+
+	if dropped {
+		client.released <- ErrTooSlow
+	}
+
+	close(client.released)
+}
+
+// Keeps the most recent output, up to a fixed size.
+type outputBuffer struct {
+	buf  []byte
+	size int
+}
+
+func newOutputBuffer(size int) *outputBuffer {
+	return &outputBuffer{
+		size: size,
+	}
+}
+
+// Write appends to the buffer, discarding the oldest output once it is full.
+func (b *outputBuffer) Write(p []byte) {
+	if len(p) >= b.size {
+		b.buf = append(b.buf[:0], p[len(p)-b.size:]...)
+		return
+	}
+
+	if overflow := len(b.buf) + len(p) - b.size; overflow > 0 {
+		b.buf = append(b.buf[:0], b.buf[overflow:]...)
+	}
+
+	b.buf = append(b.buf, p...)
+}
+
+// Bytes returns the buffered output.
+func (b *outputBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Helper function to describe how to reattach to a session.
+func resumeUsage(token, user string) string {
+	return fmt.Sprintf("ssh -t %s@<host>", resumePrefix+joinSeparator+token+joinSeparator+user)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/previousnext/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// A client with a terminal, which disconnects when its input is closed.
+type resumeClient struct {
+	ssh.Session
+
+	stdin  *io.PipeReader
+	input  *io.PipeWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+	window ssh.Window
+
+	mu     sync.Mutex
+	output bytes.Buffer
+	exited bool
+	code   int
+}
+
+func newResumeClient() *resumeClient {
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &resumeClient{
+		stdin:  r,
+		input:  w,
+		ctx:    ctx,
+		cancel: cancel,
+		window: ssh.Window{Width: 80, Height: 24},
+	}
+}
+
+func (c *resumeClient) Pty() (ssh.Pty, <-chan ssh.Window, bool) {
+	return ssh.Pty{Window: c.window}, make(chan ssh.Window), true
+}
+
+func (c *resumeClient) Context() context.Context {
+	return c.ctx
+}
+
+func (c *resumeClient) Read(p []byte) (int, error) {
+	return c.stdin.Read(p)
+}
+
+func (c *resumeClient) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.output.Write(p)
+}
+
+func (c *resumeClient) Exit(code int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.exited = true
+	c.code = code
+	return nil
+}
+
+func (c *resumeClient) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.output.String()
+}
+
+func (c *resumeClient) disconnect() {
+	c.input.Close()
+	c.cancel()
+}
+
+// Output is written to clients in the background, so this waits for it to arrive.
+func (c *resumeClient) waitFor(t *testing.T, output string) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for c.String() != output && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, output, c.String())
+}
+
+// A client which never reads its output.
+type stuckClient struct {
+	*resumeClient
+	unblock chan struct{}
+}
+
+func (c *stuckClient) Write(p []byte) (int, error) {
+	<-c.unblock
+	return len(p), nil
+}
+
+func TestParseResumeUsername(t *testing.T) {
+	token, user, ok := parseResumeUsername("resume+abc123+nick")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", token)
+	assert.Equal(t, "nick", user)
+
+	for _, username := range []string{"resume+abc123", "resume++nick", "join+abc123+nick", "foo~bar~nick"} {
+		_, _, ok := parseResumeUsername(username)
+		assert.False(t, ok, username)
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	b := newOutputBuffer(8)
+
+	b.Write([]byte("abc"))
+	assert.Equal(t, "abc", string(b.Bytes()))
+
+	b.Write([]byte("defgh"))
+	assert.Equal(t, "abcdefgh", string(b.Bytes()))
+
+	b.Write([]byte("ij"))
+	assert.Equal(t, "cdefghij", string(b.Bytes()))
+
+	b.Write([]byte("0123456789"))
+	assert.Equal(t, "23456789", string(b.Bytes()))
+}
+
+func TestResumableSession(t *testing.T) {
+	expired := make(chan struct{})
+
+	s := NewResumableSession("abc123", "token", "foo", "nick", 50*time.Millisecond, 1024, func() {
+		close(expired)
+	})
+
+	first := newResumeClient()
+	released := s.Attach(first, false)
+
+	// Input from the attached client is sent to the command.
+	go first.input.Write([]byte("ls\n"))
+
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(s.Stdin(), buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls\n", string(buf))
+
+	s.Write([]byte("file.txt\n"))
+	first.waitFor(t, "file.txt\n")
+
+	// Output is buffered while the client is disconnected.
+	first.disconnect()
+	<-released
+
+	s.Write([]byte("done\n"))
+	assert.Equal(t, "file.txt\n", first.String())
+
+	// Reattaching replays the buffered output and stops the grace period.
+	second := newResumeClient()
+	second.window = ssh.Window{Width: 100, Height: 30}
+	released = s.Attach(second, true)
+	second.waitFor(t, "file.txt\ndone\n")
+	assert.Equal(t, ssh.Window{Width: 100, Height: 30}, <-s.Windows())
+
+	// The exit status goes to the attached client.
+	s.Finish(func(client ssh.Session) {
+		client.Exit(0)
+	})
+	<-released
+	assert.True(t, second.exited)
+	assert.True(t, s.Finished())
+
+	select {
+	case <-expired:
+		t.Fatal("session expired after it was resumed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResumableSessionExpired(t *testing.T) {
+	expired := make(chan struct{})
+
+	s := NewResumableSession("abc123", "token", "foo", "nick", 10*time.Millisecond, 1024, func() {
+		close(expired)
+	})
+
+	client := newResumeClient()
+	s.Attach(client, false)
+	client.disconnect()
+
+	select {
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not expire")
+	}
+}
+
+func TestResumableSessionSlowClient(t *testing.T) {
+	s := NewResumableSession("abc123", "token", "foo", "nick", time.Minute, 1024, func() {})
+
+	client := &stuckClient{newResumeClient(), make(chan struct{})}
+	released := s.Attach(client, false)
+
+	// Writes never wait for the client, which is dropped once its queue is full.
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i <= resumeOutputQueue+1; i++ {
+			s.Write([]byte("x"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes were held up by a slow client")
+	}
+
+	assert.False(t, s.attached(client))
+
+	close(client.unblock)
+	assert.Equal(t, ErrTooSlow, <-released)
+
+	// Finishing never waits for a client which was dropped.
+	s.Finish(nil)
+	assert.True(t, s.Finished())
+}
+
+func TestLeaveResumableSlowClient(t *testing.T) {
+	s := NewResumableSession("abc123", "token", "foo", "nick", time.Minute, 1024, func() {})
+
+	released := make(chan error, 1)
+	released <- ErrTooSlow
+	close(released)
+
+	// A client which was dropped is told how to resume the session, which keeps running.
+	client := newResumeClient()
+	leaveResumable(client, s, released, log.New(), "nick")
+
+	assert.True(t, client.exited)
+	assert.Equal(t, exitCodeGateway, client.code)
+	assert.Contains(t, client.String(), resumeUsage("token", "nick"))
+	assert.False(t, s.Finished())
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	promlog "github.com/prometheus/common/log"
+	gossh "golang.org/x/crypto/ssh"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/previousnext/k8s-ssh/audit"
+	"github.com/previousnext/log"
+)
+
+// Labels added to the services created for reverse port forwarding, so they can be removed
+// by Cleanup if the gateway exits without cleaning up.
+const (
+	labelManagedBy = "app.kubernetes.io/managed-by"
+	labelUser      = "ssh.skpr.io/user"
+	managedBy      = "k8s-ssh"
+)
+
+// ReverseForwarder exposes ports forwarded by clients (ssh -R) inside the user's namespace,
+// with a Service and Endpoints which send traffic to a listener on the gateway pod.
+type ReverseForwarder struct {
+	clientset  kubernetes.Interface
+	authorizer *Authorizer
+	forwarder  *Forwarder
+	policies   *PolicyLoader
+	auditor    *audit.Logger
+	podIP      string
+
+	mu        sync.Mutex
+	listeners map[string]*reverseListener
+}
+
+// NewReverseForwarder returns a reverse forwarder which points services at the gateway pod's IP.
+func NewReverseForwarder(clientset kubernetes.Interface, authorizer *Authorizer, forwarder *Forwarder, policies *PolicyLoader, auditor *audit.Logger, podIP string) *ReverseForwarder {
+	return &ReverseForwarder{
+		clientset:  clientset,
+		authorizer: authorizer,
+		forwarder:  forwarder,
+		policies:   policies,
+		auditor:    auditor,
+		podIP:      podIP,
+		listeners:  make(map[string]*reverseListener),
+	}
+}
+
+// A port exposed by a client.
+type reverseListener struct {
+	listener  net.Listener
+	namespace string
+	service   string
+	logger    log.Log
+}
+
+// Payload of "tcpip-forward" and "cancel-tcpip-forward" requests, as specified in RFC 4254, section 7.1.
+type reverseForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// Payload of "forwarded-tcpip" channels, as specified in RFC 4254, section 7.2.
+type reverseForwardData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// Handlers returns the handlers for the global requests used by reverse port forwarding.
+func (r *ReverseForwarder) Handlers(router Router) map[string]ssh.RequestHandler {
+	return map[string]ssh.RequestHandler{
+		"tcpip-forward":        r.forwardHandler(router),
+		"cancel-tcpip-forward": r.cancelHandler,
+	}
+}
+
+// Helper function to build the handler which exposes a port.
+func (r *ReverseForwarder) forwardHandler(router Router) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		// Generate a unique ID for this port.
+		// This will be used for logging connections.
+		logger := log.New()
+
+		var payload reverseForwardRequest
+
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			return false, nil
+		}
+
+		if r.podIP == "" {
+			logger.Print("Refused reverse port forward, the gateway pod IP has not been configured")
+			return false, nil
+		}
+
+		identity, user, err := router.Identity(ctx.User())
+		if err != nil {
+			return false, nil
+		}
+
+		key, _ := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+
+		namespace, err := r.forwarder.Namespace(identity, "", user, key)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Refused reverse port forward for user %s: %s", user, err.Error()))
+			return false, nil
+		}
+
+		if _, err := r.authorizer.User(namespace, user, key); err != nil {
+			logger.Print(fmt.Sprintf("Refused reverse port forward for user %s in namespace %s: %s", user, namespace, err.Error()))
+			return false, nil
+		}
+
+		policy, err := r.policies.Load(namespace)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Refused reverse port forward for user %s, failed to load policy for namespace %s: %s", user, namespace, err.Error()))
+			return false, nil
+		}
+
+		if !policy.ReverseForwarding {
+			logger.Print(fmt.Sprintf("Refused reverse port forward for user %s, it is disabled for namespace %s", user, namespace))
+			return false, nil
+		}
+
+		// Only listen on the pod IP the endpoints point at, connections are checked in serve as the
+		// pod IP can be reached from every namespace.
+		listener, err := net.Listen("tcp", net.JoinHostPort(r.podIP, "0"))
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to listen for reverse port forward for user %s: %s", user, err.Error()))
+			return false, nil
+		}
+
+		targetPort := listener.Addr().(*net.TCPAddr).Port
+
+		// Clients can ask for any free port, the service can use the same port as the listener.
+		port := int(payload.BindPort)
+		if port == 0 {
+			port = targetPort
+		}
+
+		rl := &reverseListener{
+			listener:  listener,
+			namespace: namespace,
+			service:   reverseServiceName(payload.BindAddr, user, port),
+			logger:    logger,
+		}
+
+		err = r.expose(rl, user, port, targetPort)
+		if err != nil {
+			logger.Print(fmt.Sprintf("Failed to expose reverse port forward for user %s as %s.%s:%d: %s", user, rl.service, namespace, port, err.Error()))
+			listener.Close()
+			return false, nil
+		}
+
+		id := reverseListenerID(ctx, payload)
+
+		r.mu.Lock()
+		r.listeners[id] = rl
+		r.mu.Unlock()
+
+		logger.Print(fmt.Sprintf("Exposed reverse port forward for user %s from %s as %s.%s:%d", user, ctx.RemoteAddr(), rl.service, namespace, port))
+
+		r.auditor.Emit(audit.Event{
+			Type:        audit.TypeForwardOpen,
+			Session:     logger.ID(),
+			User:        user,
+			Fingerprint: fingerprint(key),
+			RemoteAddr:  ctx.RemoteAddr().String(),
+			Namespace:   namespace,
+			Forward: &audit.Forward{
+				Kind: audit.ForwardReverse,
+				Host: rl.service + "." + namespace,
+				Port: uint32(port),
+			},
+		})
+
+		go r.serve(ctx, rl, payload)
+
+		// The listener is removed when the client disconnects, if it was not cancelled first.
+		go func() {
+			<-ctx.Done()
+			r.close(id)
+		}()
+
+		if payload.BindPort == 0 {
+			return true, gossh.Marshal(struct{ Port uint32 }{uint32(port)})
+		}
+
+		return true, nil
+	}
+}
+
+// Helper function to handle requests to stop exposing a port.
+func (r *ReverseForwarder) cancelHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var payload reverseForwardRequest
+
+	if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+		return false, nil
+	}
+
+	return r.close(reverseListenerID(ctx, payload)), nil
+}
+
+// Helper function to identify a listener by the connection and the address the client asked for.
+func reverseListenerID(ctx ssh.Context, payload reverseForwardRequest) string {
+	return ctx.SessionID() + "/" + net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort)))
+}
+
+// Helper function to create the Service and Endpoints which send traffic to the listener.
+func (r *ReverseForwarder) expose(rl *reverseListener, user string, port, targetPort int) error {
+	meta := meta_v1.ObjectMeta{
+		Name:      rl.service,
+		Namespace: rl.namespace,
+		Labels: map[string]string{
+			labelManagedBy: managedBy,
+			labelUser:      user,
+		},
+	}
+
+	// A service without a selector, so the endpoints can point at the gateway pod.
+	_, err := r.clientset.CoreV1().Services(rl.namespace).Create(&v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{
+					Name:       "tcp",
+					Protocol:   v1.ProtocolTCP,
+					Port:       int32(port),
+					TargetPort: intstr.FromInt(targetPort),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.clientset.CoreV1().Endpoints(rl.namespace).Create(&v1.Endpoints{
+		ObjectMeta: meta,
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP: r.podIP,
+					},
+				},
+				Ports: []v1.EndpointPort{
+					{
+						Name:     "tcp",
+						Protocol: v1.ProtocolTCP,
+						Port:     int32(targetPort),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		r.clientset.CoreV1().Services(rl.namespace).Delete(rl.service, &meta_v1.DeleteOptions{})
+		return err
+	}
+
+	return nil
+}
+
+// Helper function to forward connections from the listener back to the client.
+func (r *ReverseForwarder) serve(ctx ssh.Context, rl *reverseListener, payload reverseForwardRequest) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return
+	}
+
+	for {
+		c, err := rl.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(c net.Conn) {
+			defer c.Close()
+
+			origin := c.RemoteAddr().(*net.TCPAddr)
+
+			allowed, err := r.fromNamespace(rl.namespace, origin.IP)
+			if err != nil {
+				rl.logger.Print(fmt.Sprintf("Failed to check the source of reverse port forward connection from %s: %s", origin, err.Error()))
+				return
+			}
+
+			if !allowed {
+				rl.logger.Print(fmt.Sprintf("Refused reverse port forward connection from %s, it is not a pod in namespace %s", origin, rl.namespace))
+				return
+			}
+
+			ch, reqs, err := conn.OpenChannel("forwarded-tcpip", gossh.Marshal(reverseForwardData{
+				DestAddr:   payload.BindAddr,
+				DestPort:   payload.BindPort,
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			}))
+			if err != nil {
+				rl.logger.Print(fmt.Sprintf("Failed to open reverse port forward from %s to the client: %s", origin, err.Error()))
+				return
+			}
+			go gossh.DiscardRequests(reqs)
+
+			untrack := trackSession(rl.namespace, sessionTypeForward)
+			sent, received, _ := tunnel(ch, c.(*net.TCPConn))
+			untrack(sent, received)
+
+			rl.logger.Print(fmt.Sprintf("Closed reverse port forward connection from %s (sent %d bytes, received %d bytes)", origin, sent, received))
+		}(c)
+	}
+}
+
+// Cleanup removes the services and endpoints which point at the gateway pod's IP, left behind
+// if the gateway was killed before it could remove them. They would otherwise send traffic to
+// whichever pod is given the IP next.
+func (r *ReverseForwarder) Cleanup() error {
+	if r.podIP == "" {
+		return nil
+	}
+
+	list, err := r.clientset.CoreV1().Endpoints(meta_v1.NamespaceAll).List(meta_v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelManagedBy: managedBy}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, endpoints := range list.Items {
+		if !endpointsHaveIP(endpoints, r.podIP) {
+			continue
+		}
+
+		if err := r.clientset.CoreV1().Endpoints(endpoints.Namespace).Delete(endpoints.Name, &meta_v1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		if err := r.clientset.CoreV1().Services(endpoints.Namespace).Delete(endpoints.Name, &meta_v1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		promlog.Info("Removed leftover reverse port forward:", endpoints.Name+"."+endpoints.Namespace)
+	}
+
+	return nil
+}
+
+// Helper function to check if the endpoints send traffic to the IP.
+func endpointsHaveIP(endpoints v1.Endpoints, ip string) bool {
+	for _, subset := range endpoints.Subsets {
+		for _, address := range append(subset.Addresses, subset.NotReadyAddresses...) {
+			if address.IP == ip {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Helper function to check if a connection comes from a pod in the namespace the port is exposed in.
+func (r *ReverseForwarder) fromNamespace(namespace string, ip net.IP) (bool, error) {
+	pods, err := r.clientset.CoreV1().Pods(namespace).List(meta_v1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("status.podIP", ip.String()).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, pod := range pods.Items {
+		// Field selectors are not supported by all versions of the API server.
+		if pod.Status.PodIP == ip.String() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Helper function to stop exposing a port, returning false if it was not found.
+func (r *ReverseForwarder) close(id string) bool {
+	r.mu.Lock()
+	rl, ok := r.listeners[id]
+	delete(r.listeners, id)
+	r.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	rl.listener.Close()
+
+	if err := r.clientset.CoreV1().Endpoints(rl.namespace).Delete(rl.service, &meta_v1.DeleteOptions{}); err != nil {
+		rl.logger.Print(fmt.Sprintf("Failed to delete endpoints %s.%s: %s", rl.service, rl.namespace, err.Error()))
+	}
+
+	if err := r.clientset.CoreV1().Services(rl.namespace).Delete(rl.service, &meta_v1.DeleteOptions{}); err != nil {
+		rl.logger.Print(fmt.Sprintf("Failed to delete service %s.%s: %s", rl.service, rl.namespace, err.Error()))
+	}
+
+	rl.logger.Print(fmt.Sprintf("Removed reverse port forward %s.%s", rl.service, rl.namespace))
+
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Routers which can be selected with the --router flag.
+const (
+	routerTilde = "tilde"
+	routerDot   = "dot"
+	routerSlash = "slash"
+	routerEnv   = "env"
+	routerMenu  = "menu"
+)
+
+// Target is where a session will be connected.
+type Target struct {
+	Namespace string
+	Pod       string
+	Container string
+	User      string
+}
+
+// Router determines where a session should be connected.
+type Router interface {
+	// Identity returns the namespace and SshUser name used to authenticate a username.
+	// The namespace is empty when it is not known until the session starts.
+	Identity(username string) (string, string, error)
+
+	// Target returns where the session should be connected.
+	Target(sess ssh.Session) (Target, error)
+}
+
+// SeparatorRouter reads the target from the username eg. "namespace~pod~container~user".
+type SeparatorRouter struct {
+	separator string
+}
+
+// NewSeparatorRouter returns a router for usernames split by the separator.
+func NewSeparatorRouter(separator string) *SeparatorRouter {
+	return &SeparatorRouter{
+		separator: separator,
+	}
+}
+
+// Identity returns the namespace and user from the username.
+func (r *SeparatorRouter) Identity(username string) (string, string, error) {
+	namespace, _, _, user, err := splitUser(username, r.separator)
+	return namespace, user, err
+}
+
+// Target returns the namespace, pod, container and user from the username.
+func (r *SeparatorRouter) Target(sess ssh.Session) (Target, error) {
+	namespace, pod, container, user, err := splitUser(sess.User(), r.separator)
+	if err != nil {
+		return Target{}, err
+	}
+
+	return Target{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		User:      user,
+	}, nil
+}
+
+// EnvRouter reads the target from an environment variable sent by the client eg.
+//
+//	ssh -o SendEnv=K8S_TARGET user@host
+//
+// where K8S_TARGET is "namespace/pod/container".
+type EnvRouter struct {
+	variable string
+}
+
+// NewEnvRouter returns a router which reads the target from the environment variable.
+func NewEnvRouter(variable string) *EnvRouter {
+	return &EnvRouter{
+		variable: variable,
+	}
+}
+
+// Identity returns the username as is, the namespace is not known until the session starts.
+func (r *EnvRouter) Identity(username string) (string, string, error) {
+	return "", username, nil
+}
+
+// Target returns the namespace, pod and container from the environment variable.
+func (r *EnvRouter) Target(sess ssh.Session) (Target, error) {
+	value, ok := getEnv(sess.Environ(), r.variable)
+	if !ok {
+		return Target{}, fmt.Errorf("environment variable %s was not sent, connect using: ssh -o SendEnv=%s", r.variable, r.variable)
+	}
+
+	namespace, pod, container, err := splitTarget(value, "/")
+	if err != nil {
+		return Target{}, err
+	}
+
+	return Target{
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+		User:      sess.User(),
+	}, nil
+}
+
+// MenuRouter asks the user to pick a namespace and pod from an interactive menu.
+type MenuRouter struct {
+	authorizer *Authorizer
+	pods       *PodResolver
+}
+
+// NewMenuRouter returns a router which presents the namespaces and pods the user can connect to.
+func NewMenuRouter(authorizer *Authorizer, pods *PodResolver) *MenuRouter {
+	return &MenuRouter{
+		authorizer: authorizer,
+		pods:       pods,
+	}
+}
+
+// Identity returns the username as is, the namespace is not known until the session starts.
+func (r *MenuRouter) Identity(username string) (string, string, error) {
+	return "", username, nil
+}
+
+// Target asks the user which namespace and pod to connect to.
+func (r *MenuRouter) Target(sess ssh.Session) (Target, error) {
+	if _, _, isPty := sess.Pty(); !isPty {
+		return Target{}, fmt.Errorf("a terminal is required to choose a pod, connect using: ssh -t")
+	}
+
+	namespaces, err := r.authorizer.Namespaces(sess.User(), sess.PublicKey())
+	if err != nil {
+		return Target{}, err
+	}
+
+	namespace, err := choose(sess, "Namespaces:", namespaces)
+	if err != nil {
+		return Target{}, err
+	}
+
+	pods, err := r.pods.List(namespace)
+	if err != nil {
+		return Target{}, err
+	}
+
+	pod, err := choose(sess, fmt.Sprintf("Pods in %s:", namespace), pods)
+	if err != nil {
+		return Target{}, err
+	}
+
+	return Target{
+		Namespace: namespace,
+		Pod:       pod,
+		User:      sess.User(),
+	}, nil
+}
+
+// Helper function to skip the menu when there is only one choice.
+func choose(sess ssh.Session, title string, choices []string) (string, error) {
+	switch len(choices) {
+	case 0:
+		return "", fmt.Errorf("nothing to choose from: %s", strings.TrimSuffix(title, ":"))
+	case 1:
+		return choices[0], nil
+	}
+
+	return promptChoice(sess, title, choices)
+}
+
+// Helper function to look up a variable from a list of "key=value" strings.
+func getEnv(env []string, key string) (string, bool) {
+	for _, kv := range env {
+		sl := strings.SplitN(kv, "=", 2)
+		if len(sl) == 2 && sl[0] == key {
+			return sl[1], true
+		}
+	}
+
+	return "", false
+}
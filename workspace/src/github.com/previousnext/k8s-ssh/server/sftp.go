@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Name of the SFTP subsystem requested by clients.
+const subsystemSFTP = "sftp"
+
+// Script which prints the first sftp-server binary found in the container.
+const sftpServerProbe = `for p in "$@"; do if [ -x "$p" ]; then echo "$p"; exit 0; fi; done; command -v sftp-server`
+
+// PodRunner runs commands in a container. It is used by the built in SFTP server
+// when the container does not have an sftp-server binary.
+type PodRunner struct {
+	ctx    context.Context
+	config *rest.Config
+	url    func(*v1.PodExecOptions) *url.URL
+}
+
+// NewPodRunner returns a runner for the container, commands are torn down when the context is cancelled.
+func NewPodRunner(ctx context.Context, config *rest.Config, url func(*v1.PodExecOptions) *url.URL) *PodRunner {
+	return &PodRunner{
+		ctx:    ctx,
+		config: config,
+		url:    url,
+	}
+}
+
+// Container returns a key which identifies the container commands are run in.
+func (r *PodRunner) Container() string {
+	return r.url(&v1.PodExecOptions{}).String()
+}
+
+// Run runs the command and waits for it to exit, returning an error if it failed.
+func (r *PodRunner) Run(cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return r.run(r.ctx, cmd, stdin, stdout, stderr)
+}
+
+// RunContext is like Run, but the command is also torn down when the context is cancelled.
+func (r *PodRunner) RunContext(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return r.run(ctx, cmd, stdin, stdout, stderr)
+}
+
+// Helper function to run a command which is torn down when the context is cancelled.
+func (r *PodRunner) run(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	exec, err := newExecutor(ctx, r.config, r.url(&v1.PodExecOptions{
+		Stdin:   stdin != nil,
+		Stdout:  true,
+		Stderr:  true,
+		Command: cmd,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return exec.Stream(remotecommand.StreamOptions{
+		SupportedProtocols: remotecommandconsts.SupportedStreamingProtocols,
+		Stdin:              stdin,
+		Stdout:             stdout,
+		Stderr:             stderr,
+	})
+}
+
+// Helper function to find the sftp-server binary in the container, returning an empty
+// string if there isn't one.
+func findSftpServer(runner *PodRunner, paths []string) string {
+	var stdout bytes.Buffer
+
+	cmd := append([]string{"sh", "-c", sftpServerProbe, "sh"}, paths...)
+
+	if err := runner.Run(cmd, nil, &stdout, ioutil.Discard); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(stdout.String())
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Environment variable the client sends to share their session eg.
+//
+//	ssh -o SetEnv=K8S_SSH_SHARE=ro -t namespace~pod~user@host
+//
+// where the value is the mode other users can join with.
+const envShare = "K8S_SSH_SHARE"
+
+// Modes a shared session can be joined with.
+const (
+	shareReadOnly  = "ro"
+	shareReadWrite = "rw"
+)
+
+// Usernames used to join a shared session eg. "join+<session id>+<user>". Kubernetes names
+// cannot contain "+", so these never clash with a router.
+const (
+	joinSeparator   = "+"
+	joinReadOnly    = "join"
+	joinReadWrite   = "join-rw"
+	joinOutputQueue = 1024
+)
+
+// Keys which detach a read-only viewer (Ctrl-C and Ctrl-D).
+var detachKeys = []byte{0x03, 0x04}
+
+// Errors returned by Attach when a viewer is disconnected.
+var (
+	ErrSessionEnded = errors.New("session ended")
+	ErrTooSlow      = errors.New("disconnected for not keeping up with the session output")
+)
+
+// Helper function to parse a username used to join a shared session, returning false if it is not one.
+func parseJoinUsername(username string) (id, user, mode string, ok bool) {
+	sl := strings.Split(username, joinSeparator)
+	if len(sl) != 3 || sl[1] == "" || sl[2] == "" {
+		return "", "", "", false
+	}
+
+	switch sl[0] {
+	case joinReadOnly:
+		return sl[1], sl[2], shareReadOnly, true
+	case joinReadWrite:
+		return sl[1], sl[2], shareReadWrite, true
+	}
+
+	return "", "", "", false
+}
+
+// Helper function to get the mode a session is shared with, returning false if the client
+// did not ask for it to be shared.
+func shareMode(environ []string) (string, bool, error) {
+	value, ok := getEnv(environ, envShare)
+	if !ok || value == "" {
+		return "", false, nil
+	}
+
+	switch value {
+	case shareReadOnly, shareReadWrite:
+		return value, true, nil
+	}
+
+	return "", false, fmt.Errorf("invalid value for %s: %s (expected %s or %s)", envShare, value, shareReadOnly, shareReadWrite)
+}
+
+// SessionHub holds the sessions which have been shared on this gateway.
+type SessionHub struct {
+	mu       sync.Mutex
+	sessions map[string]*SharedSession
+}
+
+// NewSessionHub returns an empty hub.
+func NewSessionHub() *SessionHub {
+	return &SessionHub{
+		sessions: make(map[string]*SharedSession),
+	}
+}
+
+// Publish allows other users to join the session.
+func (h *SessionHub) Publish(s *SharedSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sessions[s.ID] = s
+}
+
+// Remove stops other users joining the session.
+func (h *SessionHub) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, id)
+}
+
+// Get returns a shared session.
+func (h *SessionHub) Get(id string) (*SharedSession, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[id]
+	return s, ok
+}
+
+// SharedSession is a TTY session which other users can watch or type into. Every client
+// receives the same output and the terminal is sized to fit the smallest client.
+type SharedSession struct {
+	ID        string
+	Namespace string
+	Owner     string
+	Mode      string
+
+	stdin *io.PipeReader
+	input *io.PipeWriter
+
+	mu      sync.Mutex
+	owner   ssh.Window
+	viewers map[*viewer]struct{}
+	windows chan ssh.Window
+	closed  bool
+}
+
+// A user who joined a shared session.
+type viewer struct {
+	window  ssh.Window
+	output  chan []byte
+	dropped bool
+}
+
+// NewSharedSession returns a session which reads input from the owner and follows the size
+// of their window, until Close is called.
+func NewSharedSession(id, namespace, owner, mode string, stdin io.Reader, window ssh.Window, winCh <-chan ssh.Window) *SharedSession {
+	r, w := io.Pipe()
+
+	s := &SharedSession{
+		ID:        id,
+		Namespace: namespace,
+		Owner:     owner,
+		Mode:      mode,
+		stdin:     r,
+		input:     w,
+		owner:     window,
+		viewers:   make(map[*viewer]struct{}),
+		windows:   make(chan ssh.Window, 1),
+	}
+
+	go func() {
+		_, err := io.Copy(w, stdin)
+		w.CloseWithError(err)
+	}()
+
+	go func() {
+		for win := range winCh {
+			s.mu.Lock()
+			s.owner = win
+			s.mu.Unlock()
+
+			s.resize()
+		}
+	}()
+
+	return s
+}
+
+// Stdin returns the input from the owner and any users who joined in read-write mode.
+func (s *SharedSession) Stdin() io.Reader {
+	return s.stdin
+}
+
+// Output returns a writer which writes to the owner and sends a copy to every viewer.
+func (s *SharedSession) Output(w io.Writer) io.Writer {
+	return &sharedWriter{w, s}
+}
+
+// Window returns the size of the smallest client.
+func (s *SharedSession) Window() ssh.Window {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.window()
+}
+
+// Windows returns the size of the smallest client whenever a client resizes, joins or leaves.
+func (s *SharedSession) Windows() <-chan ssh.Window {
+	return s.windows
+}
+
+// Attach sends the session's output to the viewer's terminal until they leave or the session
+// ends. Input from read-write viewers is sent to the command, read-only viewers can leave
+// with Ctrl-C or Ctrl-D.
+func (s *SharedSession) Attach(sess ssh.Session, mode string) error {
+	pty, winCh, _ := sess.Pty()
+
+	v := &viewer{
+		window: pty.Window,
+		output: make(chan []byte, joinOutputQueue),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSessionEnded
+	}
+	s.viewers[v] = struct{}{}
+	s.mu.Unlock()
+
+	defer s.detach(v)
+
+	s.resize()
+
+	left := make(chan struct{})
+
+	go func() {
+		defer close(left)
+
+		if mode == shareReadWrite {
+			io.Copy(s.input, sess)
+			return
+		}
+
+		buf := make([]byte, 256)
+
+		for {
+			n, err := sess.Read(buf)
+			if err != nil || containsAny(buf[:n], detachKeys) {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-left:
+			return nil
+
+		case <-sess.Context().Done():
+			return nil
+
+		case win, ok := <-winCh:
+			if !ok {
+				winCh = nil
+				continue
+			}
+
+			s.mu.Lock()
+			v.window = win
+			s.mu.Unlock()
+
+			s.resize()
+
+		case data, ok := <-v.output:
+			if !ok {
+				s.mu.Lock()
+				dropped := v.dropped
+				s.mu.Unlock()
+
+				if dropped {
+					return ErrTooSlow
+				}
+
+				return ErrSessionEnded
+			}
+
+			if _, err := sess.Write(data); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// Viewers returns how many users have joined the session.
+func (s *SharedSession) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.viewers)
+}
+
+// Close disconnects every viewer.
+func (s *SharedSession) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+
+	for v := range s.viewers {
+		close(v.output)
+		delete(s.viewers, v)
+	}
+}
+
+// Helper function to remove a viewer, if it has not already been removed.
+func (s *SharedSession) detach(v *viewer) {
+	s.mu.Lock()
+	_, ok := s.viewers[v]
+	if ok {
+		close(v.output)
+		delete(s.viewers, v)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.resize()
+	}
+}
+
+// Helper function to send output to every viewer. Viewers who cannot keep up are disconnected,
+// so they never slow down the owner.
+func (s *SharedSession) broadcast(p []byte) {
+	s.mu.Lock()
+
+	if len(s.viewers) == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	dropped := false
+
+	for v := range s.viewers {
+		select {
+		case v.output <- data:
+		default:
+			v.dropped = true
+			close(v.output)
+			delete(s.viewers, v)
+			dropped = true
+		}
+	}
+
+	s.mu.Unlock()
+
+	if dropped {
+		s.resize()
+	}
+}
+
+// Helper function to send the size of the smallest client.
+func (s *SharedSession) resize() {
+	s.mu.Lock()
+	win := s.window()
+	s.mu.Unlock()
+
+	sendWindow(s.windows, win)
+}
+
+// Helper function to send a window size, replacing any size which has not been read yet.
+func sendWindow(windows chan ssh.Window, win ssh.Window) {
+	for {
+		select {
+		case windows <- win:
+			return
+		default:
+		}
+
+		select {
+		case <-windows:
+		default:
+		}
+	}
+}
+
+// Helper function to get the size of the smallest client, ignoring clients without a size.
+// The lock must be held.
+func (s *SharedSession) window() ssh.Window {
+	win := s.owner
+
+	for v := range s.viewers {
+		win = smallestWindow(win, v.window)
+	}
+
+	return win
+}
+
+// Helper function to get a window which fits inside both windows.
+func smallestWindow(a, b ssh.Window) ssh.Window {
+	if a.Width <= 0 || a.Height <= 0 {
+		return b
+	}
+
+	if b.Width <= 0 || b.Height <= 0 {
+		return a
+	}
+
+	if b.Width < a.Width {
+		a.Width = b.Width
+	}
+
+	if b.Height < a.Height {
+		a.Height = b.Height
+	}
+
+	return a
+}
+
+// Helper function to check if the data contains any of the bytes.
+func containsAny(data, bytes []byte) bool {
+	for _, b := range data {
+		for _, c := range bytes {
+			if b == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Writes to the owner and copies the output to the viewers.
+type sharedWriter struct {
+	w io.Writer
+	s *SharedSession
+}
+
+func (w *sharedWriter) Write(p []byte) (int, error) {
+	w.s.broadcast(p)
+	return w.w.Write(p)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJoinUsername(t *testing.T) {
+	id, user, mode, ok := parseJoinUsername("join+abc123+nick")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", id)
+	assert.Equal(t, "nick", user)
+	assert.Equal(t, shareReadOnly, mode)
+
+	_, _, mode, ok = parseJoinUsername("join-rw+abc123+nick")
+	assert.True(t, ok)
+	assert.Equal(t, shareReadWrite, mode)
+
+	for _, username := range []string{"join~abc123~nick", "join+abc123", "join++nick", "watch+abc123+nick", "foo~bar~nick"} {
+		_, _, _, ok := parseJoinUsername(username)
+		assert.False(t, ok, username)
+	}
+}
+
+func TestShareMode(t *testing.T) {
+	_, share, err := shareMode([]string{"TERM=xterm"})
+	assert.Nil(t, err)
+	assert.False(t, share)
+
+	mode, share, err := shareMode([]string{"K8S_SSH_SHARE=rw"})
+	assert.Nil(t, err)
+	assert.True(t, share)
+	assert.Equal(t, shareReadWrite, mode)
+
+	_, _, err = shareMode([]string{"K8S_SSH_SHARE=yes"})
+	assert.NotNil(t, err)
+}
+
+func TestSmallestWindow(t *testing.T) {
+	assert.Equal(t, ssh.Window{Width: 80, Height: 24}, smallestWindow(ssh.Window{Width: 120, Height: 24}, ssh.Window{Width: 80, Height: 40}))
+	assert.Equal(t, ssh.Window{Width: 80, Height: 24}, smallestWindow(ssh.Window{}, ssh.Window{Width: 80, Height: 24}))
+	assert.Equal(t, ssh.Window{Width: 80, Height: 24}, smallestWindow(ssh.Window{Width: 80, Height: 24}, ssh.Window{}))
+}
+
+func TestSharedSession(t *testing.T) {
+	winCh := make(chan ssh.Window)
+
+	s := NewSharedSession("abc123", "foo", "nick", shareReadWrite, strings.NewReader("ls\n"), ssh.Window{Width: 120, Height: 40}, winCh)
+
+	// Input from the owner is passed through.
+	input, err := ioutil.ReadAll(s.Stdin())
+	assert.Nil(t, err)
+	assert.Equal(t, "ls\n", string(input))
+
+	assert.Equal(t, ssh.Window{Width: 120, Height: 40}, s.Window())
+
+	v := &viewer{
+		window: ssh.Window{Width: 80, Height: 50},
+		output: make(chan []byte, 1),
+	}
+
+	s.mu.Lock()
+	s.viewers[v] = struct{}{}
+	s.mu.Unlock()
+
+	assert.Equal(t, ssh.Window{Width: 80, Height: 40}, s.Window())
+
+	// The owner resizing is sent to the command.
+	winCh <- ssh.Window{Width: 100, Height: 30}
+	close(winCh)
+	assert.Equal(t, ssh.Window{Width: 80, Height: 30}, <-s.Windows())
+
+	// Output goes to the owner and the viewer.
+	var owner bytes.Buffer
+
+	out := s.Output(&owner)
+	out.Write([]byte("file.txt\n"))
+	assert.Equal(t, "file.txt\n", owner.String())
+	assert.Equal(t, "file.txt\n", string(<-v.output))
+
+	// Viewers who fall behind are disconnected instead of blocking the owner.
+	out.Write([]byte("one"))
+	out.Write([]byte("two"))
+	assert.Equal(t, "file.txt\nonetwo", owner.String())
+	assert.Equal(t, "one", string(<-v.output))
+
+	_, ok := <-v.output
+	assert.False(t, ok)
+	assert.True(t, v.dropped)
+	assert.Equal(t, 0, s.Viewers())
+	assert.Equal(t, ssh.Window{Width: 100, Height: 30}, s.Window())
+
+	s.Close()
+	s.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	promlog "github.com/prometheus/common/log"
+)
+
+// How long sessions are given to clean up, eg. kill orphaned commands, once they have been closed during shutdown.
+const shutdownCleanup = 5 * time.Second
+
+// Drainer keeps track of the sessions which are running, so they can be warned and closed when the server shuts down.
+type Drainer struct {
+	mu       sync.Mutex
+	sessions map[*drainSession]struct{}
+	notice   string
+	reason   string
+}
+
+type drainSession struct {
+	warn  io.Writer
+	close func(reason string)
+}
+
+// NewDrainer returns a drainer without any sessions.
+func NewDrainer() *Drainer {
+	return &Drainer{
+		sessions: make(map[*drainSession]struct{}),
+	}
+}
+
+// Add a session, the user is warned on the writer and close is called if it is still running when the
+// server has finished draining. The returned function removes the session once it has finished.
+func (d *Drainer) Add(warn io.Writer, close func(reason string)) func() {
+	session := &drainSession{warn, close}
+
+	d.mu.Lock()
+	d.sessions[session] = struct{}{}
+	notice, reason := d.notice, d.reason
+	d.mu.Unlock()
+
+	// Sessions which start while the server is shutting down are warned or closed straight away.
+	if reason != "" {
+		close(reason)
+	} else if notice != "" {
+		fmt.Fprint(warn, notice)
+	}
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		delete(d.sessions, session)
+	}
+}
+
+// Len returns how many sessions are running.
+func (d *Drainer) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.sessions)
+}
+
+// Notify writes the notice to every session, and to sessions which start later.
+func (d *Drainer) Notify(notice string) {
+	for _, session := range d.list(notice, "") {
+		fmt.Fprint(session.warn, notice)
+	}
+}
+
+// Close every session for the reason given, and sessions which start later.
+func (d *Drainer) Close(reason string) {
+	for _, session := range d.list("", reason) {
+		session.close(reason)
+	}
+}
+
+// Wait until every session has finished, or the context is done.
+func (d *Drainer) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for d.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// Helper function to store the notice or reason for new sessions and return the sessions which are running.
+func (d *Drainer) list(notice, reason string) []*drainSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if notice != "" {
+		d.notice = notice
+	}
+
+	if reason != "" {
+		d.reason = reason
+	}
+
+	var sessions []*drainSession
+	for session := range d.sessions {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// Helper function to shut the server down once it receives SIGTERM or SIGINT. It stops accepting connections,
+// warns users and waits up to the timeout for their sessions to finish, before closing the rest. The returned
+// channel is closed once the server has shut down.
+func shutdownOnSignal(srv *ssh.Server, ready *Readiness, drainer *Drainer, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		defer close(done)
+
+		sig := <-signals
+		signal.Stop(signals)
+
+		promlog.Infof("Received %s, waiting up to %s for %d sessions to finish", sig, timeout, drainer.Len())
+
+		ready.Drain()
+		drainer.Notify(fmt.Sprintf("\r\nThe server is shutting down, this session will be closed in %s.\r\n", timeout))
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			promlog.Infof("Closing %d sessions which are still running", drainer.Len())
+		}
+
+		// Sessions which can be resumed keep running after their client disconnects, so they are closed here too.
+		drainer.Close(timeoutShutdown)
+
+		cleanup, cancelCleanup := context.WithTimeout(context.Background(), shutdownCleanup)
+		defer cancelCleanup()
+
+		if err := drainer.Wait(cleanup); err != nil {
+			promlog.Infof("Gave up waiting for %d sessions to clean up", drainer.Len())
+		}
+
+		srv.Close()
+	}()
+
+	return done
+}
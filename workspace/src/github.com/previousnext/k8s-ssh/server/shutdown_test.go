@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainer(t *testing.T) {
+	drainer := NewDrainer()
+
+	var (
+		warn   bytes.Buffer
+		closed []string
+	)
+
+	remove := drainer.Add(&warn, func(reason string) {
+		closed = append(closed, reason)
+	})
+	assert.Equal(t, 1, drainer.Len())
+
+	drainer.Notify("shutting down\r\n")
+	assert.Equal(t, "shutting down\r\n", warn.String())
+
+	drainer.Close(timeoutShutdown)
+	assert.Equal(t, []string{timeoutShutdown}, closed)
+
+	// Sessions which start after the server has drained are closed straight away.
+	var late bytes.Buffer
+	drainer.Add(&late, func(reason string) {
+		closed = append(closed, reason)
+	})()
+	assert.Equal(t, []string{timeoutShutdown, timeoutShutdown}, closed)
+
+	remove()
+	assert.Nil(t, drainer.Wait(context.Background()))
+}
+
+func TestDrainerWait(t *testing.T) {
+	drainer := NewDrainer()
+	drainer.Add(&bytes.Buffer{}, func(reason string) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, drainer.Wait(ctx))
+}
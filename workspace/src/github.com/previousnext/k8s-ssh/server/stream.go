@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// Script which records the PID of a command before replacing itself with the command, so
+// the process group can be found again if the client disconnects.
+const orphanWrapper = `echo $$ > %s; exec "$@"`
+
+// Script which hangs up the recorded process group, giving it time to exit before it is killed.
+const orphanKiller = `pid=$(cat %[1]s 2>/dev/null) || exit 0; rm -f %[1]s; kill -HUP -- -$pid 2>/dev/null || kill -HUP $pid 2>/dev/null; sleep 5; kill -KILL -- -$pid 2>/dev/null || kill -KILL $pid 2>/dev/null; exit 0`
+
+// cancelableUpgrader closes the streaming connection to the API server when its context is
+// cancelled, so the remote command does not outlive the SSH session.
+type cancelableUpgrader struct {
+	httpstream.UpgradeRoundTripper
+	ctx context.Context
+
+	// When the upgrade was requested, to measure how long the API server took to set it up.
+	started time.Time
+}
+
+// RoundTrip requests the upgrade.
+func (u *cancelableUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.started = time.Now()
+	return u.UpgradeRoundTripper.RoundTrip(req)
+}
+
+// NewConnection upgrades the response and watches the context for cancellation.
+func (u *cancelableUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.UpgradeRoundTripper.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.started.IsZero() {
+		metricExecSetup.Observe(time.Since(u.started).Seconds())
+	}
+
+	go func() {
+		select {
+		case <-u.ctx.Done():
+			conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+
+	return conn, nil
+}
+
+// Helper function to create an executor which is torn down when the context is cancelled.
+// It can also be used to dial other streaming endpoints eg. port forwarding.
+func newExecutor(ctx context.Context, config *rest.Config, url *url.URL) (remotecommand.StreamExecutor, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrader := &cancelableUpgrader{
+		UpgradeRoundTripper: spdy.NewRoundTripper(tlsConfig, true),
+		ctx:                 ctx,
+	}
+
+	wrapper, err := rest.HTTPWrappersForConfig(config, upgrader)
+	if err != nil {
+		return nil, err
+	}
+
+	return remotecommand.NewStreamExecutor(upgrader, func(http.RoundTripper) http.RoundTripper {
+		return wrapper
+	}, "POST", url)
+}
+
+// Helper function to get the path of the file used to record the PID of a session's command.
+func orphanPidFile(id string) string {
+	return fmt.Sprintf("/tmp/.k8s-ssh-%s.pid", id)
+}
+
+// Helper function to wrap a command so its PID is recorded in the pid file.
+func orphanCommand(pidFile string, cmd []string) []string {
+	return append([]string{"sh", "-c", fmt.Sprintf(orphanWrapper, pidFile), "sh"}, cmd...)
+}
+
+// Helper function to build the command which terminates the process group of a command
+// which was left running after the client disconnected.
+func orphanKillCommand(pidFile string) []string {
+	return []string{"sh", "-c", fmt.Sprintf(orphanKiller, pidFile)}
+}
+
+// Helper function to run a command in the container, discarding its output.
+func runCommand(config *rest.Config, url *url.URL) error {
+	exec, err := remotecommand.NewExecutor(config, "POST", url)
+	if err != nil {
+		return err
+	}
+
+	return exec.Stream(remotecommand.StreamOptions{
+		SupportedProtocols: remotecommandconsts.SupportedStreamingProtocols,
+		Stdout:             ioutil.Discard,
+		Stderr:             ioutil.Discard,
+	})
+}
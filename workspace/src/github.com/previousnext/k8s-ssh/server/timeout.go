@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Exit code returned when the gateway closes a session because it was idle for too long,
+// reached its maximum length, the server shut down or its recording failed.
+const exitCodeTimeout = 254
+
+// Reasons a watchdog closes a session.
+const (
+	timeoutIdle = "idle timeout"
+	timeoutMax  = "maximum session length"
+
+	// Sessions which are still running when the server has finished draining.
+	timeoutShutdown = "server shutdown"
+
+	// Sessions which must be recorded, once the recording can not be written.
+	timeoutRecording = "recording failure"
+)
+
+// Watchdog closes sessions which have been idle for too long or have reached their maximum length.
+type Watchdog struct {
+	idle    time.Duration
+	max     time.Duration
+	warning time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	last   time.Time
+	warned string
+	reason string
+}
+
+// NewWatchdog returns a watchdog for a session which starts now. A timeout of zero is disabled.
+func NewWatchdog(idle, max, warning time.Duration) *Watchdog {
+	now := time.Now()
+
+	return &Watchdog{
+		idle:    idle,
+		max:     max,
+		warning: warning,
+		start:   now,
+		last:    now,
+	}
+}
+
+// Reader marks the session as active whenever input is read.
+func (w *Watchdog) Reader(r io.Reader) io.Reader {
+	return &watchdogReader{r, w}
+}
+
+// Writer marks the session as active whenever output is written.
+func (w *Watchdog) Writer(wr io.Writer) io.Writer {
+	return &watchdogWriter{wr, w}
+}
+
+// Reason returns why the session was closed, or an empty string if it has not expired.
+func (w *Watchdog) Reason() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.reason
+}
+
+// Watch warns the user on the writer before the session expires and calls expire once it has.
+// It returns when the session expires or the context is cancelled.
+func (w *Watchdog) Watch(ctx context.Context, warn io.Writer, expire func(reason string)) {
+	if w.idle <= 0 && w.max <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			reason, remaining := w.check(now)
+
+			if reason == "" {
+				continue
+			}
+
+			if remaining <= 0 {
+				if w.Close(warn, reason) {
+					expire(reason)
+				}
+				return
+			}
+
+			fmt.Fprintf(warn, "\r\nSession will be closed in %s due to %s.\r\n", roundDuration(remaining, time.Second), reason)
+		}
+	}
+}
+
+// Close expires the session for the reason given and tells the user on the writer. It returns
+// false if the session had already expired, so it is only closed once.
+func (w *Watchdog) Close(warn io.Writer, reason string) bool {
+	w.mu.Lock()
+	if w.reason != "" {
+		w.mu.Unlock()
+		return false
+	}
+	w.reason = reason
+	w.mu.Unlock()
+
+	fmt.Fprintf(warn, "\r\nSession closed due to %s.\r\n", reason)
+
+	return true
+}
+
+// Helper function to determine if the session needs a warning. It returns the reason and how
+// long is left the first time a warning is due, and every time once the session has expired.
+func (w *Watchdog) check(now time.Time) (string, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reason, remaining := "", time.Duration(0)
+
+	if w.idle > 0 {
+		reason, remaining = timeoutIdle, w.last.Add(w.idle).Sub(now)
+	}
+
+	if w.max > 0 {
+		if left := w.start.Add(w.max).Sub(now); reason == "" || left < remaining {
+			reason, remaining = timeoutMax, left
+		}
+	}
+
+	if remaining <= 0 {
+		return reason, remaining
+	}
+
+	if remaining > w.warning || w.warned == reason {
+		return "", remaining
+	}
+
+	w.warned = reason
+
+	return reason, remaining
+}
+
+// Helper function to record activity on the session.
+func (w *Watchdog) touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.last = time.Now()
+
+	// A new warning is needed if the user goes idle again.
+	if w.warned == timeoutIdle {
+		w.warned = ""
+	}
+}
+
+// Helper function to check often enough that the warnings are on time.
+func (w *Watchdog) interval() time.Duration {
+	interval := time.Second
+
+	for _, d := range []time.Duration{w.idle / 10, w.max / 10, w.warning / 10} {
+		if d > 0 && d < interval {
+			interval = d
+		}
+	}
+
+	return interval
+}
+
+// Helper function to round a positive duration to the nearest multiple of the unit, as
+// time.Duration.Round does in Go 1.9.
+func roundDuration(d, unit time.Duration) time.Duration {
+	r := d % unit
+	if r+r < unit {
+		return d - r
+	}
+
+	return d + unit - r
+}
+
+type watchdogReader struct {
+	r io.Reader
+	w *Watchdog
+}
+
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
+
+type watchdogWriter struct {
+	wr io.Writer
+	w  *Watchdog
+}
+
+func (w *watchdogWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.w.touch()
+	}
+	return w.wr.Write(p)
+}
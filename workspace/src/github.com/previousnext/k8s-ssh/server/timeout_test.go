@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Buffer which can be written to by the watchdog while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchdogIdle(t *testing.T) {
+	watchdog := NewWatchdog(200*time.Millisecond, 0, 100*time.Millisecond)
+
+	var (
+		warn    syncBuffer
+		expired string
+	)
+
+	watchdog.Watch(context.Background(), &warn, func(reason string) {
+		expired = reason
+	})
+
+	assert.Equal(t, timeoutIdle, expired)
+	assert.Equal(t, timeoutIdle, watchdog.Reason())
+	assert.Contains(t, warn.String(), "Session will be closed in")
+	assert.Contains(t, warn.String(), "Session closed due to idle timeout")
+}
+
+func TestWatchdogActivity(t *testing.T) {
+	watchdog := NewWatchdog(200*time.Millisecond, 0, 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var warn syncBuffer
+
+	go watchdog.Watch(ctx, &warn, func(reason string) {})
+
+	writer := watchdog.Writer(&bytes.Buffer{})
+
+	// Keep the session busy for longer than the idle timeout.
+	for i := 0; i < 10; i++ {
+		writer.Write([]byte("."))
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	assert.Equal(t, "", watchdog.Reason())
+	assert.Equal(t, "", warn.String())
+}
+
+func TestWatchdogMax(t *testing.T) {
+	watchdog := NewWatchdog(time.Hour, 200*time.Millisecond, 100*time.Millisecond)
+
+	var expired string
+
+	watchdog.Watch(context.Background(), &bytes.Buffer{}, func(reason string) {
+		expired = reason
+	})
+
+	assert.Equal(t, timeoutMax, expired)
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	watchdog := NewWatchdog(0, 0, time.Minute)
+
+	// Returns straight away when there is nothing to watch.
+	watchdog.Watch(context.Background(), &bytes.Buffer{}, func(reason string) {})
+
+	assert.Equal(t, "", watchdog.Reason())
+}
+
+func TestWatchdogClose(t *testing.T) {
+	watchdog := NewWatchdog(0, 0, time.Minute)
+
+	var warn bytes.Buffer
+
+	assert.True(t, watchdog.Close(&warn, timeoutShutdown))
+	assert.False(t, watchdog.Close(&warn, timeoutIdle))
+	assert.Equal(t, timeoutShutdown, watchdog.Reason())
+	assert.Equal(t, "\r\nSession closed due to server shutdown.\r\n", warn.String())
+}
+
+func TestRoundDuration(t *testing.T) {
+	assert.Equal(t, 59*time.Second, roundDuration(59*time.Second+400*time.Millisecond, time.Second))
+	assert.Equal(t, time.Minute, roundDuration(59*time.Second+500*time.Millisecond, time.Second))
+	assert.Equal(t, 2*time.Hour, roundDuration(2*time.Hour, time.Second))
+}
@@ -2,24 +2,53 @@ package main
 
 import (
 	"fmt"
+	"path"
 	"strings"
 )
 
-const separator = "~"
-
 // Used for mashalling a ssh username into
 //  * Namespace
 //  * Pod
-//  * Container
+//  * Container (optional, resolved from the pod when omitted or left empty)
 //  * User
-func splitUser(user string) (string, string, string, string, error) {
-	sl := strings.Split(user, separator)
+func splitUser(user, separator string) (string, string, string, string, error) {
+	i := strings.LastIndex(user, separator)
+	if i < 0 {
+		return "", "", "", "", fmt.Errorf("failed to marshal string: %s", user)
+	}
 
-	if len(sl) == 4 {
-		return sl[0], sl[1], sl[2], sl[3], nil
+	namespace, pod, container, err := splitTarget(user[:i], separator)
+	if err != nil || user[i+len(separator):] == "" {
+		return "", "", "", "", fmt.Errorf("failed to marshal string: %s", user)
 	}
 
-	return "", "", "", "", fmt.Errorf("failed to marshal string: %s", user)
+	return namespace, pod, container, user[i+len(separator):], nil
+}
+
+// Used for mashalling a target into
+//  * Namespace
+//  * Pod
+//  * Container (optional)
+func splitTarget(target, separator string) (string, string, string, error) {
+	sl := strings.Split(target, separator)
+
+	// Workloads can be targeted with a prefix eg. "deploy/web", which needs to be
+	// put back together when slashes are also used to separate the target.
+	if separator == "/" && len(sl) > 2 {
+		if _, ok := podKinds[strings.ToLower(sl[1])]; ok {
+			sl = append([]string{sl[0], sl[1] + "/" + sl[2]}, sl[3:]...)
+		}
+	}
+
+	if len(sl) == 3 {
+		return sl[0], sl[1], sl[2], nil
+	}
+
+	if len(sl) == 2 {
+		return sl[0], sl[1], "", nil
+	}
+
+	return "", "", "", fmt.Errorf("failed to marshal target: %s", target)
 }
 
 // Helper function to determine if the command = shell.
@@ -31,6 +60,12 @@ func isShell(cmd []string) bool {
 	return false
 }
 
+// Helper function to run a command string with a shell. The command string is passed as
+// a single argument so the shell sees it exactly as the user typed it.
+func shellCommand(shell, raw string) []string {
+	return []string{shell, "-c", raw}
+}
+
 // Helper function to determine if user is rsyncing.
 func isRsync(cmd []string) bool {
 	if len(cmd) > 0 && cmd[0] == "rsync" {
@@ -39,3 +74,197 @@ func isRsync(cmd []string) bool {
 
 	return false
 }
+
+// Helper function to check if the command is scp receiving (-t) or sending (-f) files
+// eg. "scp -r -t -- /app".
+func isScp(cmd []string) bool {
+	if len(cmd) == 0 || path.Base(cmd[0]) != "scp" {
+		return false
+	}
+
+	for _, arg := range cmd[1:] {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		if strings.ContainsAny(arg[1:], "tf") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Suffixes of cluster DNS names which are removed from forwarding destinations.
+var clusterDomains = []string{".svc.cluster.local", ".svc"}
+
+// Helper function to split a forwarding destination into a service or pod name and an
+// optional namespace eg. "api", "api.my-namespace" or "api.my-namespace.svc.cluster.local".
+func splitForwardHost(host string) (string, string, error) {
+	host = strings.TrimSuffix(host, ".")
+
+	for _, domain := range clusterDomains {
+		if strings.HasSuffix(host, domain) {
+			host = strings.TrimSuffix(host, domain)
+			break
+		}
+	}
+
+	sl := strings.Split(host, ".")
+
+	switch {
+	case len(sl) == 1 && sl[0] != "":
+		return sl[0], "", nil
+	case len(sl) == 2 && sl[0] != "" && sl[1] != "":
+		return sl[0], sl[1], nil
+	}
+
+	return "", "", fmt.Errorf("unsupported destination, expected service, service.namespace or pod: %s", host)
+}
+
+// Helper function to name the service for a reverse port forward. The bind address is used
+// if it is a valid service name eg. "ssh -R webhook:8080:localhost:3000", otherwise the name
+// is generated from the user and port.
+func reverseServiceName(bindAddr, user string, port int) string {
+	if isDNSLabel(bindAddr) && bindAddr != "localhost" {
+		return bindAddr
+	}
+
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, user)
+
+	suffix := fmt.Sprintf("-%d", port)
+
+	name = "ssh-" + name
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+
+	return strings.TrimRight(name, "-") + suffix
+}
+
+// Helper function to check if a name can be used for a service (RFC 1035 label).
+func isDNSLabel(name string) bool {
+	if len(name) == 0 || len(name) > 63 || name[0] < 'a' || name[0] > 'z' || name[len(name)-1] == '-' {
+		return false
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Kinds of workload which can be targeted from the pod segment of a username.
+const (
+	podKindPod         = "pod"
+	podKindDeployment  = "deployment"
+	podKindStatefulSet = "statefulset"
+	podKindDaemonSet   = "daemonset"
+	podKindService     = "service"
+	podKindSelector    = "selector"
+)
+
+// Short and long names which can prefix the pod segment eg. "deploy/web".
+var podKinds = map[string]string{
+	"po":          podKindPod,
+	"pod":         podKindPod,
+	"deploy":      podKindDeployment,
+	"deployment":  podKindDeployment,
+	"sts":         podKindStatefulSet,
+	"statefulset": podKindStatefulSet,
+	"ds":          podKindDaemonSet,
+	"daemonset":   podKindDaemonSet,
+	"svc":         podKindService,
+	"service":     podKindService,
+}
+
+// Used for marshalling the pod segment of a username into the kind of object being
+// targeted and its name eg.
+//   - "web-1234" is a pod
+//   - "deploy/web" is a deployment
+//   - "app=web,tier=frontend" is a label selector
+func splitPodTarget(target string) (string, string, error) {
+	if strings.Contains(target, "=") {
+		return podKindSelector, target, nil
+	}
+
+	sl := strings.SplitN(target, "/", 2)
+
+	if len(sl) == 1 && sl[0] != "" {
+		return podKindPod, sl[0], nil
+	}
+
+	if len(sl) == 2 && sl[1] != "" {
+		if kind, ok := podKinds[strings.ToLower(sl[0])]; ok {
+			return kind, sl[1], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("failed to marshal pod target: %s", target)
+}
+
+// Helper function to split a StatefulSet pod name into the StatefulSet name and ordinal eg. "db-0".
+func splitOrdinal(name string) (string, bool) {
+	i := strings.LastIndex(name, "-")
+	if i < 1 || i == len(name)-1 {
+		return "", false
+	}
+
+	for _, r := range name[i+1:] {
+		if r < '0' || r > '9' {
+			return "", false
+		}
+	}
+
+	return name[:i], true
+}
+
+// Helper function to determine if a list contains a value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Helper function to pick the default container for a pod. The annotated default container
+// wins, followed by the only container which is not a sidecar. If there is more than one
+// candidate they are returned so the user can choose.
+func defaultContainer(annotation string, containers, sidecars []string) (string, []string) {
+	if annotation != "" && contains(containers, annotation) {
+		return annotation, nil
+	}
+
+	var candidates []string
+
+	for _, container := range containers {
+		if !contains(sidecars, container) {
+			candidates = append(candidates, container)
+		}
+	}
+
+	// Fall back to the sidecars if that is all the pod is running.
+	if len(candidates) == 0 {
+		candidates = containers
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	return "", candidates
+}
@@ -1,16 +1,169 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestSplitUser(t *testing.T) {
-	namespace, pod, container, user, err := splitUser("foo~bar~baz~nick")
+	namespace, pod, container, user, err := splitUser("foo~bar~baz~nick", "~")
 	assert.Nil(t, err)
 	assert.Equal(t, "foo", namespace)
 	assert.Equal(t, "bar", pod)
 	assert.Equal(t, "baz", container)
 	assert.Equal(t, "nick", user)
+
+	namespace, pod, container, user, err = splitUser("foo~bar~nick", "~")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", namespace)
+	assert.Equal(t, "bar", pod)
+	assert.Equal(t, "", container)
+	assert.Equal(t, "nick", user)
+
+	_, _, container, _, err = splitUser("foo~bar~~nick", "~")
+	assert.Nil(t, err)
+	assert.Equal(t, "", container)
+
+	_, _, _, _, err = splitUser("foo~nick", "~")
+	assert.NotNil(t, err)
+
+	_, _, _, _, err = splitUser("foo~bar~baz~", "~")
+	assert.NotNil(t, err)
+
+	namespace, pod, container, user, err = splitUser("foo.bar.baz.nick", ".")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", namespace)
+	assert.Equal(t, "bar", pod)
+	assert.Equal(t, "baz", container)
+	assert.Equal(t, "nick", user)
+
+	namespace, pod, container, user, err = splitUser("foo/deploy/bar/baz/nick", "/")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", namespace)
+	assert.Equal(t, "deploy/bar", pod)
+	assert.Equal(t, "baz", container)
+	assert.Equal(t, "nick", user)
+}
+
+func TestSplitTarget(t *testing.T) {
+	namespace, pod, container, err := splitTarget("foo/sts/db", "/")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", namespace)
+	assert.Equal(t, "sts/db", pod)
+	assert.Equal(t, "", container)
+
+	namespace, pod, container, err = splitTarget("foo~deploy/web~php", "~")
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", namespace)
+	assert.Equal(t, "deploy/web", pod)
+	assert.Equal(t, "php", container)
+
+	_, _, _, err = splitTarget("foo", "/")
+	assert.NotNil(t, err)
+}
+
+func TestSplitPodTarget(t *testing.T) {
+	kind, name, err := splitPodTarget("web-1234")
+	assert.Nil(t, err)
+	assert.Equal(t, podKindPod, kind)
+	assert.Equal(t, "web-1234", name)
+
+	kind, name, err = splitPodTarget("deploy/web")
+	assert.Nil(t, err)
+	assert.Equal(t, podKindDeployment, kind)
+	assert.Equal(t, "web", name)
+
+	kind, name, err = splitPodTarget("sts/db-0")
+	assert.Nil(t, err)
+	assert.Equal(t, podKindStatefulSet, kind)
+	assert.Equal(t, "db-0", name)
+
+	kind, name, err = splitPodTarget("app=web,tier=frontend")
+	assert.Nil(t, err)
+	assert.Equal(t, podKindSelector, kind)
+	assert.Equal(t, "app=web,tier=frontend", name)
+
+	_, _, err = splitPodTarget("foo/bar")
+	assert.NotNil(t, err)
+
+	_, _, err = splitPodTarget("deploy/")
+	assert.NotNil(t, err)
+}
+
+func TestSplitOrdinal(t *testing.T) {
+	name, ok := splitOrdinal("db-0")
+	assert.True(t, ok)
+	assert.Equal(t, "db", name)
+
+	_, ok = splitOrdinal("db-primary")
+	assert.False(t, ok)
+
+	_, ok = splitOrdinal("db")
+	assert.False(t, ok)
+}
+
+func TestDefaultContainer(t *testing.T) {
+	container, candidates := defaultContainer("", []string{"app"}, []string{"istio-proxy"})
+	assert.Equal(t, "app", container)
+	assert.Empty(t, candidates)
+
+	container, candidates = defaultContainer("", []string{"istio-proxy", "app"}, []string{"istio-proxy"})
+	assert.Equal(t, "app", container)
+	assert.Empty(t, candidates)
+
+	container, candidates = defaultContainer("php", []string{"nginx", "php"}, []string{})
+	assert.Equal(t, "php", container)
+	assert.Empty(t, candidates)
+
+	container, candidates = defaultContainer("missing", []string{"nginx", "php"}, []string{})
+	assert.Equal(t, "", container)
+	assert.Equal(t, []string{"nginx", "php"}, candidates)
+
+	container, candidates = defaultContainer("", []string{"istio-proxy"}, []string{"istio-proxy"})
+	assert.Equal(t, "istio-proxy", container)
+	assert.Empty(t, candidates)
+}
+
+func TestShellCommand(t *testing.T) {
+	assert.Equal(t, []string{"/bin/bash", "-c", "cd /app && echo \"a  b\""}, shellCommand("/bin/bash", "cd /app && echo \"a  b\""))
+}
+
+func TestIsScp(t *testing.T) {
+	assert.True(t, isScp([]string{"scp", "-t", "--", "/app"}))
+	assert.True(t, isScp([]string{"scp", "-r", "-p", "-f", "--", "/app"}))
+	assert.True(t, isScp([]string{"/usr/bin/scp", "-pt", "/app"}))
+	assert.False(t, isScp([]string{"scp", "--", "-t"}))
+	assert.False(t, isScp([]string{"scp", "/app", "-t"}))
+	assert.False(t, isScp([]string{"rsync", "-t"}))
+	assert.False(t, isScp([]string{}))
+}
+
+func TestSplitForwardHost(t *testing.T) {
+	for host, expected := range map[string][2]string{
+		"api":                                 {"api", ""},
+		"api.my-namespace":                    {"api", "my-namespace"},
+		"api.my-namespace.svc":                {"api", "my-namespace"},
+		"api.my-namespace.svc.cluster.local.": {"api", "my-namespace"},
+	} {
+		name, namespace, err := splitForwardHost(host)
+		assert.Nil(t, err, host)
+		assert.Equal(t, expected[0], name, host)
+		assert.Equal(t, expected[1], namespace, host)
+	}
+
+	for _, host := range []string{"", "10.0.0.1", ".svc", "a.b.c", ".api"} {
+		_, _, err := splitForwardHost(host)
+		assert.NotNil(t, err, host)
+	}
+}
+
+func TestReverseServiceName(t *testing.T) {
+	assert.Equal(t, "webhook", reverseServiceName("webhook", "nick", 8080))
+	assert.Equal(t, "ssh-nick-8080", reverseServiceName("localhost", "nick", 8080))
+	assert.Equal(t, "ssh-nick-8080", reverseServiceName("", "nick", 8080))
+	assert.Equal(t, "ssh-nick-smith-8080", reverseServiceName("0.0.0.0", "Nick.Smith", 8080))
+	assert.Equal(t, "ssh-nick-8080", reverseServiceName("Web_Hook", "nick", 8080))
+	assert.Len(t, reverseServiceName("", strings.Repeat("a", 100), 8080), 63)
 }
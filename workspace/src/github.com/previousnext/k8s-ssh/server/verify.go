@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/previousnext/k8s-ssh/audit"
+)
+
+// Helper function to check audit logs written with --audit-chain, printing any records which were
+// modified, removed or reordered. The files must be given oldest first.
+func runVerify(files []string, keyPath string) error {
+	key, err := loadPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	verifier := audit.NewVerifier(key)
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		err = verifier.Verify(path, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s", path, err)
+		}
+	}
+
+	for _, problem := range verifier.Problems {
+		fmt.Println(problem)
+	}
+
+	fmt.Printf("Verified %d records and %d checkpoints in %d files\n", verifier.Records, verifier.Checkpoints, len(files))
+	fmt.Printf("Checkpoints were checked against key %s\n", gossh.FingerprintSHA256(key))
+
+	if verifier.Unsigned > 0 {
+		fmt.Printf("The last %d records are not covered by a checkpoint\n", verifier.Unsigned)
+	}
+
+	if len(verifier.Problems) > 0 {
+		return fmt.Errorf("found %d problems", len(verifier.Problems))
+	}
+
+	return nil
+}
+
+// Helper function to load a public key, from either a public key or the private key it belongs to.
+func loadPublicKey(path string) (gossh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err == nil {
+		return key, nil
+	}
+
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %s", path)
+	}
+
+	return signer.PublicKey(), nil
+}
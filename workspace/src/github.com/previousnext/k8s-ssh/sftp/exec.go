@@ -0,0 +1,424 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format used to describe files with stat: raw mode (hex), size, uid, gid, atime, mtime and name.
+const statFormat = "%f %s %u %g %X %Y %n"
+
+// Runner runs a command in the remote environment eg. a container.
+type Runner interface {
+	// RunContext runs the command and waits for it to exit, returning an error if it failed.
+	// The command is torn down if the context is cancelled.
+	RunContext(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// ExecFileSystem is a file system which runs POSIX tools (sh, stat, cat, dd etc.)
+// to access files, so it works in any container with a shell.
+type ExecFileSystem struct {
+	runner Runner
+}
+
+// NewExecFileSystem returns a file system which runs commands with the runner.
+func NewExecFileSystem(runner Runner) *ExecFileSystem {
+	return &ExecFileSystem{
+		runner: runner,
+	}
+}
+
+// Helper function to run a shell script with arguments, returning stdout. The arguments are
+// passed as positional parameters so they never need to be quoted.
+func (fs *ExecFileSystem) run(op, p, script string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := append([]string{"sh", "-c", script, "sh"}, args...)
+
+	err := fs.runner.RunContext(context.Background(), cmd, nil, &stdout, &stderr)
+	if err != nil {
+		return stdout.Bytes(), execError(op, p, stderr.String(), err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Helper function to turn the output of a failed command into an error os.IsNotExist and
+// friends understand, so the client is sent the right status code.
+func execError(op, p, stderr string, err error) error {
+	msg := strings.TrimSpace(stderr)
+
+	switch {
+	case strings.Contains(msg, "No such file"):
+		return pathError(op, p, os.ErrNotExist)
+	case strings.Contains(msg, "Permission denied"), strings.Contains(msg, "Operation not permitted"):
+		return pathError(op, p, os.ErrPermission)
+	case strings.Contains(msg, "File exists"):
+		return pathError(op, p, os.ErrExist)
+	case msg != "":
+		return pathError(op, p, errors.New(msg))
+	}
+
+	return pathError(op, p, err)
+}
+
+// Helper function to stop paths which start with a dash being read as options.
+func arg(p string) string {
+	if strings.HasPrefix(p, "-") {
+		return "./" + p
+	}
+	return p
+}
+
+// Stat returns information about a file, following symlinks.
+func (fs *ExecFileSystem) Stat(p string) (*FileInfo, error) {
+	out, err := fs.run("stat", p, `stat -L -c "$1" "$2"`, statFormat, arg(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStat(strings.TrimRight(string(out), "\n"))
+}
+
+// Lstat returns information about a file, without following symlinks.
+func (fs *ExecFileSystem) Lstat(p string) (*FileInfo, error) {
+	out, err := fs.run("lstat", p, `stat -c "$1" "$2"`, statFormat, arg(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStat(strings.TrimRight(string(out), "\n"))
+}
+
+// ReadDir returns the contents of a directory.
+func (fs *ExecFileSystem) ReadDir(p string) ([]*FileInfo, error) {
+	script := `cd "$2" || exit 1
+for f in * .[!.]* ..?*; do
+	if [ -e "$f" ] || [ -L "$f" ]; then stat -c "$1" "./$f" || exit 1; fi
+done`
+
+	out, err := fs.run("readdir", p, script, statFormat, arg(p))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*FileInfo
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+
+		info, err := parseStat(line)
+		if err != nil {
+			return nil, err
+		}
+
+		info.Name = strings.TrimPrefix(info.Name, "./")
+		files = append(files, info)
+	}
+
+	return files, nil
+}
+
+// OpenFile opens a file using the os.O_* flags.
+func (fs *ExecFileSystem) OpenFile(p string, flags int) (File, error) {
+	var script string
+
+	switch {
+	case flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		script = `if [ -e "$1" ] || [ -L "$1" ]; then echo "$1: File exists" >&2; exit 1; fi; : > "$1"`
+	case flags&os.O_TRUNC != 0:
+		script = `: > "$1"`
+	case flags&os.O_CREATE != 0:
+		script = `[ -e "$1" ] || : > "$1"`
+	default:
+		script = `if [ ! -e "$1" ]; then echo "$1: No such file or directory" >&2; exit 1; fi; if [ -d "$1" ]; then echo "$1: Is a directory" >&2; exit 1; fi`
+	}
+
+	if _, err := fs.run("open", p, script, arg(p)); err != nil {
+		return nil, err
+	}
+
+	return &execFile{
+		fs:     fs,
+		path:   arg(p),
+		append: flags&os.O_APPEND != 0,
+	}, nil
+}
+
+// Remove removes a file.
+func (fs *ExecFileSystem) Remove(p string) error {
+	_, err := fs.run("remove", p, `if [ -d "$1" ] && [ ! -L "$1" ]; then echo "$1: Is a directory" >&2; exit 1; fi; rm "$1"`, arg(p))
+	return err
+}
+
+// Mkdir creates a directory.
+func (fs *ExecFileSystem) Mkdir(p string, perm uint32) error {
+	_, err := fs.run("mkdir", p, `mkdir -m "$1" "$2"`, strconv.FormatUint(uint64(perm&ModePerm), 8), arg(p))
+	return err
+}
+
+// Rmdir removes an empty directory.
+func (fs *ExecFileSystem) Rmdir(p string) error {
+	_, err := fs.run("rmdir", p, `rmdir "$1"`, arg(p))
+	return err
+}
+
+// Rename renames a file, replacing the target if it exists.
+func (fs *ExecFileSystem) Rename(oldpath, newpath string) error {
+	// Moving a directory onto an existing directory would move it inside instead.
+	_, err := fs.run("rename", oldpath, `if [ -d "$2" ] && [ ! -L "$2" ]; then rmdir "$2" || exit 1; fi; mv -f "$1" "$2"`, arg(oldpath), arg(newpath))
+	return err
+}
+
+// Readlink returns the target of a symlink.
+func (fs *ExecFileSystem) Readlink(p string) (string, error) {
+	out, err := fs.run("readlink", p, `readlink "$1"`, arg(p))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Symlink creates a symlink at path which points to target.
+func (fs *ExecFileSystem) Symlink(target, p string) error {
+	_, err := fs.run("symlink", p, `ln -s "$1" "$2"`, target, arg(p))
+	return err
+}
+
+// Realpath returns the absolute, canonical version of a path. Paths which do not exist yet
+// are resolved relative to their parent directory.
+func (fs *ExecFileSystem) Realpath(p string) (string, error) {
+	script := `if [ -d "$1" ]; then cd "$1" && pwd -P; exit; fi
+d=$(dirname "$1"); b=$(basename "$1")
+cd "$d" || exit 1
+d=$(pwd -P)
+if [ "$d" = "/" ]; then echo "/$b"; else echo "$d/$b"; fi`
+
+	out, err := fs.run("realpath", p, script, arg(p))
+	if err != nil {
+		// Fall back to cleaning up the path so clients can still navigate.
+		if path.IsAbs(p) {
+			return path.Clean(p), nil
+		}
+
+		return "", err
+	}
+
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Chmod changes the permissions of a file.
+func (fs *ExecFileSystem) Chmod(p string, perm uint32) error {
+	_, err := fs.run("chmod", p, `chmod "$1" "$2"`, strconv.FormatUint(uint64(perm&ModePerm), 8), arg(p))
+	return err
+}
+
+// Chown changes the owner and group of a file.
+func (fs *ExecFileSystem) Chown(p string, uid, gid uint32) error {
+	_, err := fs.run("chown", p, `chown "$1" "$2"`, fmt.Sprintf("%d:%d", uid, gid), arg(p))
+	return err
+}
+
+// Chtimes changes the access and modification times of a file.
+func (fs *ExecFileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	const layout = "200601021504.05"
+
+	_, err := fs.run("chtimes", p, `TZ=UTC touch -c -a -t "$1" "$3" && TZ=UTC touch -c -m -t "$2" "$3"`, atime.UTC().Format(layout), mtime.UTC().Format(layout), arg(p))
+	return err
+}
+
+// Truncate changes the size of a file.
+func (fs *ExecFileSystem) Truncate(p string, size int64) error {
+	_, err := fs.run("truncate", p, `dd if=/dev/null of="$2" bs=1 seek="$1" 2>/dev/null || { echo "$2: Permission denied" >&2; exit 1; }`, strconv.FormatInt(size, 10), arg(p))
+	return err
+}
+
+// Helper function to parse a line of output from stat.
+func parseStat(line string) (*FileInfo, error) {
+	fields := strings.SplitN(line, " ", 7)
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("unexpected output from stat: %s", line)
+	}
+
+	var values [6]uint64
+
+	for i, base := range []int{16, 10, 10, 10, 10, 10} {
+		v, err := strconv.ParseUint(fields[i], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected output from stat: %s", line)
+		}
+		values[i] = v
+	}
+
+	return &FileInfo{
+		Mode:  uint32(values[0]),
+		Size:  int64(values[1]),
+		UID:   uint32(values[2]),
+		GID:   uint32(values[3]),
+		Atime: time.Unix(int64(values[4]), 0),
+		Mtime: time.Unix(int64(values[5]), 0),
+		Name:  fields[6],
+	}, nil
+}
+
+// execFile streams the contents of a file with a long running command. Reads and writes at
+// the next offset reuse the command, others start a new one at the right offset.
+type execFile struct {
+	fs     *ExecFileSystem
+	path   string
+	append bool
+
+	mu     sync.Mutex
+	reader *execStream
+	writer *execStream
+}
+
+// A running command along with the offset it has reached.
+type execStream struct {
+	cancel context.CancelFunc
+	pipe   io.Closer
+	r      io.Reader
+	w      io.Writer
+	offset int64
+	done   chan error
+	stderr bytes.Buffer
+}
+
+// Helper function to start a command which reads from or writes to the pipe.
+func (f *execFile) start(script string, offset int64, write bool) *execStream {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &execStream{
+		cancel: cancel,
+		offset: offset,
+		done:   make(chan error, 1),
+	}
+
+	pr, pw := io.Pipe()
+
+	var (
+		stdin  io.Reader
+		stdout io.Writer
+	)
+
+	if write {
+		s.pipe, s.w, stdin = pw, pw, pr
+	} else {
+		s.pipe, s.r, stdout = pr, pr, pw
+	}
+
+	go func() {
+		err := f.fs.runner.RunContext(ctx, []string{"sh", "-c", script, "sh", f.path, strconv.FormatInt(offset, 10)}, stdin, stdout, &s.stderr)
+		if err != nil {
+			err = execError("stream", f.path, s.stderr.String(), err)
+		}
+
+		// Unblock the other side of the pipe, reads return EOF once all of the output has been
+		// read and writes fail if the command exits early.
+		if write {
+			pr.CloseWithError(err)
+		} else {
+			pw.CloseWithError(err)
+		}
+
+		s.done <- err
+	}()
+
+	return s
+}
+
+// Helper function to stop a command, returning any error it exited with.
+func (s *execStream) stop() error {
+	if s == nil {
+		return nil
+	}
+
+	defer s.cancel()
+
+	s.pipe.Close()
+
+	// The rest of the output is not wanted, and the exec API stops reading it once the pipe is
+	// closed, so the command would never exit. Writers are left to finish writing the data.
+	if s.r != nil {
+		s.cancel()
+	}
+
+	return <-s.done
+}
+
+// ReadAt reads from the file at the offset.
+func (f *execFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.reader == nil || f.reader.offset != off {
+		f.reader.stop()
+		f.reader = f.start(`if [ "$2" -eq 0 ]; then exec cat "$1"; else exec tail -c +$(($2 + 1)) "$1"; fi`, off, false)
+	}
+
+	n, err := io.ReadFull(f.reader.r, p)
+	f.reader.offset += int64(n)
+
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	if err == io.EOF {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// WriteAt writes to the file at the offset.
+func (f *execFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.writer == nil || (!f.append && f.writer.offset != off) {
+		if err := f.writer.stop(); err != nil {
+			f.writer = nil
+			return 0, err
+		}
+
+		// The file is opened for reading and writing so it is not truncated, dd then moves
+		// the shared file descriptor to the offset before cat writes the data.
+		script := `{ dd bs=1 seek="$2" count=0 2>/dev/null; exec cat; } 1<>"$1"`
+		if f.append {
+			script = `exec cat >> "$1"`
+		}
+
+		f.writer = f.start(script, off, true)
+	}
+
+	n, err := f.writer.w.Write(p)
+	f.writer.offset += int64(n)
+
+	return n, err
+}
+
+// Close waits for any data to be written, returning any error from writing it.
+func (f *execFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reader.stop()
+
+	err := f.writer.stop()
+
+	f.reader, f.writer = nil, nil
+
+	return err
+}
@@ -0,0 +1,161 @@
+package sftp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs commands on the local machine, standing in for a container.
+type localRunner struct{}
+
+func (localRunner) RunContext(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Run()
+}
+
+func TestExecFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := NewExecFileSystem(localRunner{})
+
+	// Write a file in two chunks, then out of order.
+	f, err := fs.OpenFile(filepath.Join(dir, "foo"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("hello "), 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("world"), 6)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("W"), 6)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello World", string(data))
+
+	// Read it back from an offset.
+	f, err = fs.OpenFile(filepath.Join(dir, "foo"), os.O_RDONLY)
+	assert.Nil(t, err)
+	buf := make([]byte, 5)
+	n, err := f.ReadAt(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "World", string(buf[:n]))
+	_, err = f.ReadAt(buf, 11)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, f.Close())
+
+	_, err = fs.OpenFile(filepath.Join(dir, "foo"), os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	assert.True(t, os.IsExist(err))
+
+	info, err := fs.Stat(filepath.Join(dir, "foo"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsRegular())
+	assert.Equal(t, int64(11), info.Size)
+
+	_, err = fs.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, fs.Mkdir(filepath.Join(dir, "bar"), 0700))
+	assert.Nil(t, fs.Symlink("foo", filepath.Join(dir, ".link")))
+	assert.Nil(t, fs.Chmod(filepath.Join(dir, "foo"), 0600))
+	assert.Nil(t, fs.Truncate(filepath.Join(dir, "foo"), 5))
+
+	mtime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Nil(t, fs.Chtimes(filepath.Join(dir, "foo"), mtime, mtime))
+
+	entries, err := fs.ReadDir(dir)
+	assert.Nil(t, err)
+
+	names := make(map[string]*FileInfo)
+	for _, entry := range entries {
+		names[entry.Name] = entry
+	}
+	assert.Len(t, names, 3)
+	assert.True(t, names["bar"].IsDir())
+	assert.Equal(t, uint32(0700), names["bar"].Mode&ModePerm)
+	assert.Equal(t, ModeSymlink, names[".link"].Mode&ModeType)
+	assert.Equal(t, uint32(0600), names["foo"].Mode&ModePerm)
+	assert.Equal(t, int64(5), names["foo"].Size)
+	assert.Equal(t, mtime.Unix(), names["foo"].Mtime.Unix())
+
+	target, err := fs.Readlink(filepath.Join(dir, ".link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", target)
+
+	resolved, err := fs.Realpath(filepath.Join(dir, "bar", "..", "new"))
+	assert.Nil(t, err)
+	real, _ := filepath.EvalSymlinks(dir)
+	assert.Equal(t, filepath.Join(real, "new"), resolved)
+
+	assert.Nil(t, fs.Rename(filepath.Join(dir, "foo"), filepath.Join(dir, "bar", "foo")))
+	assert.Nil(t, fs.Remove(filepath.Join(dir, "bar", "foo")))
+	assert.Nil(t, fs.Rmdir(filepath.Join(dir, "bar")))
+	assert.NotNil(t, fs.Remove(filepath.Join(dir, "missing")))
+}
+
+// Stands in for the exec API, which stops reading a command's output once writing it fails and
+// then waits for the connection to be closed.
+type stuckRunner struct{}
+
+func (stuckRunner) RunContext(ctx context.Context, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return localRunner{}.RunContext(ctx, cmd, stdin, &stuckWriter{stdout, ctx}, stderr)
+}
+
+type stuckWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (w *stuckWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		<-w.ctx.Done()
+	}
+	return n, err
+}
+
+func TestExecFileCloseEarly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "large")
+	assert.Nil(t, ioutil.WriteFile(p, make([]byte, 4*1024*1024), 0600))
+
+	fs := NewExecFileSystem(stuckRunner{})
+
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 32*1024)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+
+	// Seeking backwards and closing partway through the file stop the command.
+	done := make(chan struct{})
+
+	go func() {
+		f.ReadAt(buf, 0)
+		f.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the file did not stop the command")
+	}
+}
@@ -0,0 +1,144 @@
+package sftp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// POSIX file type bits, as used by the SFTP permissions attribute.
+const (
+	ModeType    uint32 = 0170000
+	ModeDir     uint32 = 0040000
+	ModeRegular uint32 = 0100000
+	ModeSymlink uint32 = 0120000
+	ModePerm    uint32 = 0007777
+)
+
+// FileSystem is where the SFTP server reads and writes files.
+type FileSystem interface {
+	// Stat returns information about a file, following symlinks.
+	Stat(path string) (*FileInfo, error)
+
+	// Lstat returns information about a file, without following symlinks.
+	Lstat(path string) (*FileInfo, error)
+
+	// ReadDir returns the contents of a directory.
+	ReadDir(path string) ([]*FileInfo, error)
+
+	// OpenFile opens a file using the os.O_* flags.
+	OpenFile(path string, flags int) (File, error)
+
+	// Remove removes a file.
+	Remove(path string) error
+
+	// Mkdir creates a directory.
+	Mkdir(path string, perm uint32) error
+
+	// Rmdir removes an empty directory.
+	Rmdir(path string) error
+
+	// Rename renames a file, replacing the target if it exists.
+	Rename(oldpath, newpath string) error
+
+	// Readlink returns the target of a symlink.
+	Readlink(path string) (string, error)
+
+	// Symlink creates a symlink at path which points to target.
+	Symlink(target, path string) error
+
+	// Realpath returns the absolute, canonical version of a path.
+	Realpath(path string) (string, error)
+
+	// Chmod changes the permissions of a file.
+	Chmod(path string, perm uint32) error
+
+	// Chown changes the owner and group of a file.
+	Chown(path string, uid, gid uint32) error
+
+	// Chtimes changes the access and modification times of a file.
+	Chtimes(path string, atime, mtime time.Time) error
+
+	// Truncate changes the size of a file.
+	Truncate(path string, size int64) error
+}
+
+// File is an open file.
+type File interface {
+	// ReadAt reads from the file at the offset, returning io.EOF at the end of the file.
+	ReadAt(p []byte, off int64) (int, error)
+
+	// WriteAt writes to the file at the offset.
+	WriteAt(p []byte, off int64) (int, error)
+
+	// Close closes the file, returning any error from writing to it.
+	Close() error
+}
+
+// FileInfo describes a file.
+type FileInfo struct {
+	Name  string
+	Size  int64
+	Mode  uint32
+	UID   uint32
+	GID   uint32
+	Atime time.Time
+	Mtime time.Time
+}
+
+// IsDir returns true if the file is a directory.
+func (fi *FileInfo) IsDir() bool {
+	return fi.Mode&ModeType == ModeDir
+}
+
+// IsRegular returns true if the file is a regular file.
+func (fi *FileInfo) IsRegular() bool {
+	return fi.Mode&ModeType == ModeRegular
+}
+
+// LongName returns the file formatted like "ls -l", which clients display to users.
+func (fi *FileInfo) LongName() string {
+	date := fi.Mtime.Format("Jan _2 15:04")
+	if fi.Mtime.Before(time.Now().AddDate(0, -6, 0)) {
+		date = fi.Mtime.Format("Jan _2  2006")
+	}
+
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s", modeString(fi.Mode), 1, fi.UID, fi.GID, fi.Size, date, fi.Name)
+}
+
+// Helper function to format a POSIX mode like "ls -l" eg. "drwxr-xr-x".
+func modeString(mode uint32) string {
+	b := []byte("----------")
+
+	switch mode & ModeType {
+	case ModeDir:
+		b[0] = 'd'
+	case ModeSymlink:
+		b[0] = 'l'
+	case 0020000:
+		b[0] = 'c'
+	case 0060000:
+		b[0] = 'b'
+	case 0010000:
+		b[0] = 'p'
+	case 0140000:
+		b[0] = 's'
+	}
+
+	for i, c := range "rwxrwxrwx" {
+		if mode&(1<<uint(8-i)) != 0 {
+			b[i+1] = byte(c)
+		}
+	}
+
+	return string(b)
+}
+
+// Helper function to build an error which os.IsNotExist and friends understand.
+func pathError(op, path string, err error) error {
+	return &os.PathError{
+		Op:   op,
+		Path: path,
+		Err:  err,
+	}
+}
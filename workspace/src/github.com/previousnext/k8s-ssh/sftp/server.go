@@ -0,0 +1,739 @@
+package sftp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Version of the SFTP protocol implemented by the server (draft-ietf-secsh-filexfer-02).
+const protocolVersion = 3
+
+// Largest packet accepted from a client, OpenSSH uses the same limit.
+const maxPacketSize = 256 * 1024
+
+// Largest amount of data returned for a single read.
+const maxReadSize = 64 * 1024
+
+// Number of directory entries returned for each READDIR request.
+const readDirBatch = 100
+
+// Packet types.
+const (
+	fxpInit          = 1
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpRead          = 5
+	fxpWrite         = 6
+	fxpLstat         = 7
+	fxpFstat         = 8
+	fxpSetstat       = 9
+	fxpFsetstat      = 10
+	fxpOpendir       = 11
+	fxpReaddir       = 12
+	fxpRemove        = 13
+	fxpMkdir         = 14
+	fxpRmdir         = 15
+	fxpRealpath      = 16
+	fxpStat          = 17
+	fxpRename        = 18
+	fxpReadlink      = 19
+	fxpSymlink       = 20
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpData          = 103
+	fxpName          = 104
+	fxpAttrs         = 105
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+)
+
+// Status codes.
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// Flags for opening files.
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// Flags for which attributes are present.
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// Extension which renames files over the top of existing files, which most clients prefer.
+const extPosixRename = "posix-rename@openssh.com"
+
+// Errors returned while decoding a packet.
+var errShortPacket = errors.New("packet too short")
+
+// Server handles SFTP requests against a file system.
+type Server struct {
+	fs      FileSystem
+	handles map[string]*handle
+	next    int
+}
+
+// An open file or directory.
+type handle struct {
+	path    string
+	file    File
+	entries []*FileInfo
+	listed  bool
+}
+
+// NewServer returns a server which serves the file system.
+func NewServer(fs FileSystem) *Server {
+	return &Server{
+		fs:      fs,
+		handles: make(map[string]*handle),
+	}
+}
+
+// Serve handles requests from the channel until it is closed.
+// Open files are closed before it returns.
+func (s *Server) Serve(channel io.ReadWriter) error {
+	defer s.closeAll()
+
+	r := bufio.NewReader(channel)
+
+	for {
+		packet, err := readPacket(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp := s.handle(packet)
+		if resp == nil {
+			continue
+		}
+
+		if _, err := channel.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Helper function to read a length prefixed packet.
+func readPacket(r io.Reader) ([]byte, error) {
+	var length uint32
+
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length == 0 || length > maxPacketSize {
+		return nil, fmt.Errorf("invalid packet length: %d", length)
+	}
+
+	packet := make([]byte, length)
+
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// Helper function to process a single packet and build the response.
+func (s *Server) handle(packet []byte) []byte {
+	typ, d := packet[0], &decoder{buf: packet[1:]}
+
+	if typ == fxpInit {
+		// The client version is ignored, the server always speaks version 3.
+		return newPacket(fxpVersion).uint32(protocolVersion).string(extPosixRename).string("1").bytes()
+	}
+
+	id, err := d.uint32()
+	if err != nil {
+		return nil
+	}
+
+	switch typ {
+	case fxpOpen:
+		path, _ := d.string()
+		pflags, _ := d.uint32()
+		attrs, err := d.attrs()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		file, err := s.fs.OpenFile(path, openFlags(pflags))
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		if attrs.flags&attrPermissions != 0 && pflags&fxfCreat != 0 {
+			s.fs.Chmod(path, attrs.perm)
+		}
+
+		return s.newHandle(id, &handle{path: path, file: file})
+
+	case fxpOpendir:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		entries, err := s.fs.ReadDir(path)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return s.newHandle(id, &handle{path: path, entries: entries})
+
+	case fxpClose:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		delete(s.handles, h.name)
+
+		if h.file != nil {
+			return statusPacket(id, h.file.Close())
+		}
+
+		return statusPacket(id, nil)
+
+	case fxpRead:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		offset, _ := d.uint64()
+		length, err := d.uint32()
+		if err != nil || h.file == nil {
+			return statusPacket(id, errBadMessage(err))
+		}
+
+		if length > maxReadSize {
+			length = maxReadSize
+		}
+
+		data := make([]byte, length)
+
+		n, err := h.file.ReadAt(data, int64(offset))
+		if n == 0 && err == nil {
+			err = io.EOF
+		}
+		if n == 0 {
+			return statusPacket(id, err)
+		}
+
+		return newPacket(fxpData).uint32(id).string(string(data[:n])).bytes()
+
+	case fxpWrite:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		offset, _ := d.uint64()
+		data, err := d.string()
+		if err != nil || h.file == nil {
+			return statusPacket(id, errBadMessage(err))
+		}
+
+		_, err = h.file.WriteAt([]byte(data), int64(offset))
+
+		return statusPacket(id, err)
+
+	case fxpReaddir:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		if len(h.entries) == 0 {
+			return statusPacket(id, io.EOF)
+		}
+
+		batch := h.entries
+		if len(batch) > readDirBatch {
+			batch = batch[:readDirBatch]
+		}
+		h.entries = h.entries[len(batch):]
+
+		return namePacket(id, batch, true)
+
+	case fxpStat, fxpLstat:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		stat := s.fs.Stat
+		if typ == fxpLstat {
+			stat = s.fs.Lstat
+		}
+
+		info, err := stat(path)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return newPacket(fxpAttrs).uint32(id).attrs(info).bytes()
+
+	case fxpFstat:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		info, err := s.fs.Stat(h.path)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return newPacket(fxpAttrs).uint32(id).attrs(info).bytes()
+
+	case fxpSetstat:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		attrs, err := d.attrs()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.setstat(path, attrs))
+
+	case fxpFsetstat:
+		h, err := s.getHandle(d)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		attrs, err := d.attrs()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.setstat(h.path, attrs))
+
+	case fxpRemove:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.fs.Remove(path))
+
+	case fxpMkdir:
+		path, _ := d.string()
+		attrs, err := d.attrs()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		perm := uint32(0755)
+		if attrs.flags&attrPermissions != 0 {
+			perm = attrs.perm & ModePerm
+		}
+
+		return statusPacket(id, s.fs.Mkdir(path, perm))
+
+	case fxpRmdir:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.fs.Rmdir(path))
+
+	case fxpRealpath:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		if path == "" {
+			path = "."
+		}
+
+		resolved, err := s.fs.Realpath(path)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return namePacket(id, []*FileInfo{{Name: resolved}}, false)
+
+	case fxpRename:
+		oldpath, _ := d.string()
+		newpath, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		// Version 3 of the protocol does not allow renaming over an existing file.
+		if _, err := s.fs.Lstat(newpath); err == nil {
+			return statusPacket(id, pathError("rename", newpath, os.ErrExist))
+		}
+
+		return statusPacket(id, s.fs.Rename(oldpath, newpath))
+
+	case fxpReadlink:
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		target, err := s.fs.Readlink(path)
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return namePacket(id, []*FileInfo{{Name: target}}, false)
+
+	case fxpSymlink:
+		// OpenSSH sends the arguments in the opposite order to the draft, every client follows it.
+		target, _ := d.string()
+		path, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.fs.Symlink(target, path))
+
+	case fxpExtended:
+		name, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		if name != extPosixRename {
+			return statusPacket(id, errUnsupported)
+		}
+
+		oldpath, _ := d.string()
+		newpath, err := d.string()
+		if err != nil {
+			return statusPacket(id, err)
+		}
+
+		return statusPacket(id, s.fs.Rename(oldpath, newpath))
+	}
+
+	return statusPacket(id, errUnsupported)
+}
+
+// Helper function to apply changed attributes to a file.
+func (s *Server) setstat(path string, attrs fileAttrs) error {
+	if attrs.flags&attrSize != 0 {
+		if err := s.fs.Truncate(path, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+
+	if attrs.flags&attrPermissions != 0 {
+		if err := s.fs.Chmod(path, attrs.perm&ModePerm); err != nil {
+			return err
+		}
+	}
+
+	if attrs.flags&attrUIDGID != 0 {
+		if err := s.fs.Chown(path, attrs.uid, attrs.gid); err != nil {
+			return err
+		}
+	}
+
+	if attrs.flags&attrACModTime != 0 {
+		if err := s.fs.Chtimes(path, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper function to store a handle and build the response.
+func (s *Server) newHandle(id uint32, h *handle) []byte {
+	s.next++
+	name := strconv.Itoa(s.next)
+	s.handles[name] = h
+
+	return newPacket(fxpHandle).uint32(id).string(name).bytes()
+}
+
+// A handle along with the name it was looked up by.
+type namedHandle struct {
+	*handle
+	name string
+}
+
+// Helper function to look up the handle in a request.
+func (s *Server) getHandle(d *decoder) (namedHandle, error) {
+	name, err := d.string()
+	if err != nil {
+		return namedHandle{}, err
+	}
+
+	h, ok := s.handles[name]
+	if !ok {
+		return namedHandle{}, errInvalidHandle
+	}
+
+	return namedHandle{h, name}, nil
+}
+
+// Helper function to close all of the open files.
+func (s *Server) closeAll() {
+	for name, h := range s.handles {
+		if h.file != nil {
+			h.file.Close()
+		}
+		delete(s.handles, name)
+	}
+}
+
+// Helper function to convert SFTP open flags into os.O_* flags.
+func openFlags(pflags uint32) int {
+	var flags int
+
+	switch {
+	case pflags&fxfRead != 0 && pflags&fxfWrite != 0:
+		flags = os.O_RDWR
+	case pflags&fxfWrite != 0:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+
+	if pflags&fxfAppend != 0 {
+		flags |= os.O_APPEND
+	}
+	if pflags&fxfCreat != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&fxfTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&fxfExcl != 0 {
+		flags |= os.O_EXCL
+	}
+
+	return flags
+}
+
+// Errors which map directly onto status codes.
+var (
+	errUnsupported   = errors.New("operation not supported")
+	errInvalidHandle = errors.New("invalid handle")
+)
+
+// Helper function to report a malformed request.
+func errBadMessage(err error) error {
+	if err == nil {
+		err = errors.New("bad message")
+	}
+	return err
+}
+
+// Helper function to build a status response for the result of an operation.
+func statusPacket(id uint32, err error) []byte {
+	code, msg := uint32(fxOK), "Success"
+
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = fxEOF, "End of file"
+	case os.IsNotExist(err):
+		code, msg = fxNoSuchFile, err.Error()
+	case os.IsPermission(err):
+		code, msg = fxPermissionDenied, err.Error()
+	case err == errUnsupported:
+		code, msg = fxOpUnsupported, err.Error()
+	case err == errShortPacket:
+		code, msg = fxBadMessage, err.Error()
+	default:
+		code, msg = fxFailure, err.Error()
+	}
+
+	return newPacket(fxpStatus).uint32(id).uint32(code).string(msg).string("").bytes()
+}
+
+// Helper function to build a name response.
+func namePacket(id uint32, files []*FileInfo, long bool) []byte {
+	p := newPacket(fxpName).uint32(id).uint32(uint32(len(files)))
+
+	for _, file := range files {
+		if long {
+			p.string(file.Name).string(file.LongName()).attrs(file)
+		} else {
+			p.string(file.Name).string(file.Name).uint32(0)
+		}
+	}
+
+	return p.bytes()
+}
+
+// Attributes sent by a client.
+type fileAttrs struct {
+	flags uint32
+	size  uint64
+	uid   uint32
+	gid   uint32
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+// Helper for decoding the fields of a packet.
+type decoder struct {
+	buf []byte
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if len(d.buf) < 4 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v, nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	if len(d.buf) < 8 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(d.buf)) < n {
+		return "", errShortPacket
+	}
+	v := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return v, nil
+}
+
+func (d *decoder) attrs() (fileAttrs, error) {
+	var (
+		a   fileAttrs
+		err error
+	)
+
+	if a.flags, err = d.uint32(); err != nil {
+		return a, err
+	}
+
+	if a.flags&attrSize != 0 {
+		if a.size, err = d.uint64(); err != nil {
+			return a, err
+		}
+	}
+
+	if a.flags&attrUIDGID != 0 {
+		if a.uid, err = d.uint32(); err != nil {
+			return a, err
+		}
+		if a.gid, err = d.uint32(); err != nil {
+			return a, err
+		}
+	}
+
+	if a.flags&attrPermissions != 0 {
+		if a.perm, err = d.uint32(); err != nil {
+			return a, err
+		}
+	}
+
+	if a.flags&attrACModTime != 0 {
+		if a.atime, err = d.uint32(); err != nil {
+			return a, err
+		}
+		if a.mtime, err = d.uint32(); err != nil {
+			return a, err
+		}
+	}
+
+	if a.flags&attrExtended != 0 {
+		count, err := d.uint32()
+		if err != nil {
+			return a, err
+		}
+
+		for i := uint32(0); i < count*2; i++ {
+			if _, err := d.string(); err != nil {
+				return a, err
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// Helper for building a length prefixed packet.
+type packet struct {
+	buf []byte
+}
+
+func newPacket(typ byte) *packet {
+	return &packet{buf: []byte{0, 0, 0, 0, typ}}
+}
+
+func (p *packet) uint32(v uint32) *packet {
+	p.buf = append(p.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	return p
+}
+
+func (p *packet) uint64(v uint64) *packet {
+	return p.uint32(uint32(v >> 32)).uint32(uint32(v))
+}
+
+func (p *packet) string(v string) *packet {
+	p.uint32(uint32(len(v)))
+	p.buf = append(p.buf, v...)
+	return p
+}
+
+func (p *packet) attrs(info *FileInfo) *packet {
+	p.uint32(attrSize | attrUIDGID | attrPermissions | attrACModTime)
+	p.uint64(uint64(info.Size))
+	p.uint32(info.UID).uint32(info.GID)
+	p.uint32(info.Mode)
+	p.uint32(uint32(info.Atime.Unix())).uint32(uint32(info.Mtime.Unix()))
+	return p
+}
+
+func (p *packet) bytes() []byte {
+	binary.BigEndian.PutUint32(p.buf, uint32(len(p.buf)-4))
+	return p.buf
+}
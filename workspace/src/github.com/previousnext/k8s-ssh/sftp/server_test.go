@@ -0,0 +1,120 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Minimal client which sends a request and returns the response type and body.
+type testClient struct {
+	conn net.Conn
+	id   uint32
+}
+
+func (c *testClient) request(typ byte, p *packet) (byte, *decoder) {
+	c.id++
+
+	body := newPacket(typ).uint32(c.id)
+	body.buf = append(body.buf, p.buf[5:]...)
+	c.conn.Write(body.bytes())
+
+	resp, err := readPacket(c.conn)
+	if err != nil {
+		panic(err)
+	}
+
+	d := &decoder{buf: resp[1:]}
+	d.uint32()
+
+	return resp[0], d
+}
+
+func (c *testClient) status(typ byte, p *packet) uint32 {
+	resp, d := c.request(typ, p)
+	if resp != fxpStatus {
+		return 0xffffffff
+	}
+
+	code, _ := d.uint32()
+	return code
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conn, server := net.Pipe()
+	defer conn.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- NewServer(NewExecFileSystem(localRunner{})).Serve(server)
+		server.Close()
+	}()
+
+	conn.Write(newPacket(fxpInit).uint32(3).bytes())
+	resp, err := readPacket(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(fxpVersion), resp[0])
+
+	c := &testClient{conn: conn}
+	path := filepath.Join(dir, "foo")
+
+	// Upload a file.
+	typ, d := c.request(fxpOpen, newPacket(0).string(path).uint32(fxfWrite|fxfCreat|fxfTrunc).uint32(0))
+	assert.Equal(t, byte(fxpHandle), typ)
+	handle, _ := d.string()
+
+	assert.Equal(t, uint32(fxOK), c.status(fxpWrite, newPacket(0).string(handle).uint64(0).string("hello\x00world")))
+	assert.Equal(t, uint32(fxOK), c.status(fxpClose, newPacket(0).string(handle)))
+	assert.Equal(t, uint32(fxFailure), c.status(fxpClose, newPacket(0).string(handle)))
+
+	// Download it again.
+	typ, d = c.request(fxpOpen, newPacket(0).string(path).uint32(fxfRead).uint32(0))
+	assert.Equal(t, byte(fxpHandle), typ)
+	handle, _ = d.string()
+
+	typ, d = c.request(fxpRead, newPacket(0).string(handle).uint64(0).uint32(1024))
+	assert.Equal(t, byte(fxpData), typ)
+	data, _ := d.string()
+	assert.Equal(t, "hello\x00world", data)
+
+	assert.Equal(t, uint32(fxEOF), c.status(fxpRead, newPacket(0).string(handle).uint64(11).uint32(1024)))
+	assert.Equal(t, uint32(fxOK), c.status(fxpClose, newPacket(0).string(handle)))
+
+	// List the directory.
+	typ, d = c.request(fxpOpendir, newPacket(0).string(dir))
+	assert.Equal(t, byte(fxpHandle), typ)
+	handle, _ = d.string()
+
+	typ, d = c.request(fxpReaddir, newPacket(0).string(handle))
+	assert.Equal(t, byte(fxpName), typ)
+	count, _ := d.uint32()
+	assert.Equal(t, uint32(1), count)
+	name, _ := d.string()
+	assert.Equal(t, "foo", name)
+
+	assert.Equal(t, uint32(fxEOF), c.status(fxpReaddir, newPacket(0).string(handle)))
+	assert.Equal(t, uint32(fxOK), c.status(fxpClose, newPacket(0).string(handle)))
+
+	// Errors are mapped to status codes.
+	assert.Equal(t, uint32(fxNoSuchFile), c.status(fxpStat, newPacket(0).string(filepath.Join(dir, "missing"))))
+	assert.Equal(t, uint32(fxOK), c.status(fxpMkdir, newPacket(0).string(filepath.Join(dir, "bar")).uint32(0)))
+	assert.Equal(t, uint32(fxFailure), c.status(fxpRename, newPacket(0).string(path).string(filepath.Join(dir, "bar"))))
+	assert.Equal(t, uint32(fxOK), c.status(fxpExtended, newPacket(0).string(extPosixRename).string(path).string(filepath.Join(dir, "baz"))))
+	assert.Equal(t, uint32(fxOpUnsupported), c.status(fxpExtended, newPacket(0).string("statvfs@openssh.com")))
+
+	typ, d = c.request(fxpStat, newPacket(0).string(filepath.Join(dir, "baz")))
+	assert.Equal(t, byte(fxpAttrs), typ)
+	attrs, _ := d.attrs()
+	assert.Equal(t, uint64(11), attrs.size)
+
+	conn.Close()
+	assert.Nil(t, <-done)
+}
@@ -17,6 +17,11 @@ func New() Log {
 	}
 }
 
+// ID returns the unique id of this logging object.
+func (l Log) ID() string {
+	return l.id
+}
+
 // Print is used to format our id prefixed message.
 func (l Log) Print(msg string) {
 	log.With("id", l.id).Info(msg)